@@ -0,0 +1,404 @@
+// Package boltstore is cqrs.Store kept in single bbolt file, meant for
+// single node deployments.
+//
+// Events of every aggregate live in their own bucket, keyed by big-endian
+// version, so reading events from given version is a range scan. Aggregates
+// are indexed by their type, so Last does not scan aggregates of other
+// types. Global log is a bucket keyed by big-endian position, which points
+// to events of aggregates.
+package boltstore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/gokit/log"
+)
+
+var (
+	aggregates = []byte("aggregates") // id -> aggregate
+	events     = []byte("events")     // id -> bucket of version -> event
+	snapshots  = []byte("snapshots")  // id -> snapshot
+	types      = []byte("types")      // type -> bucket of ids
+	all        = []byte("all")        // position -> pointer
+)
+
+// pointer to event of aggregate in global log, types are kept to filter
+// log without reading events.
+type pointer struct {
+	Aggregate     string `json:"aggregate"`
+	AggregateType string `json:"aggregate_type"`
+	Version       uint64 `json:"version"`
+	Type          string `json:"type"`
+}
+
+type aggregate struct {
+	Type    string `json:"type"`
+	Version uint64 `json:"version"`
+}
+
+type entry struct {
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Schema   uint          `json:"schema,omitempty"`
+	Codec    string        `json:"codec,omitempty"`
+	Data     []byte        `json:"data"`
+	Created  time.Time     `json:"created"`
+	Metadata cqrs.Metadata `json:"metadata,omitempty"`
+	Position uint64        `json:"position"`
+}
+
+func (e entry) event(version uint64) cqrs.Event {
+	return cqrs.Event{
+		ID:       e.ID,
+		Type:     e.Type,
+		Schema:   e.Schema,
+		Codec:    e.Codec,
+		Data:     e.Data,
+		Version:  version,
+		Created:  e.Created,
+		Metadata: e.Metadata,
+		Position: e.Position,
+	}
+}
+
+type snapshot struct {
+	Version uint64 `json:"version"`
+	Data    []byte `json:"data"`
+}
+
+type Store struct {
+	db *bolt.DB
+}
+
+// Open store kept in file at path, it is created when it does not exist.
+// File is locked, so it can be opened by single process at once.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{aggregates, events, snapshots, types, all} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Save(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ps := make([]uint64, len(es))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		id := []byte(a.ID)
+		l, _, err := load(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// check if aggregate has not been changed by other request!
+		if a.Version-uint64(len(es)) != l.Version {
+			return fmt.Errorf(
+				"%s version missmatch, arrived: %d, expects: %d",
+				a.Type, a.Version, l.Version)
+		}
+
+		b, err := tx.Bucket(events).CreateBucketIfNotExists(id)
+		if err != nil {
+			return err
+		}
+
+		for i, e := range es {
+			p, err := tx.Bucket(all).NextSequence()
+			if err != nil {
+				return err
+			}
+
+			v, err := json.Marshal(pointer{
+				Aggregate:     a.ID,
+				AggregateType: a.Type,
+				Version:       e.Version,
+				Type:          e.Type,
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(all).Put(key(p), v); err != nil {
+				return err
+			}
+
+			if v, err = json.Marshal(entry{
+				ID:       e.ID,
+				Type:     e.Type,
+				Schema:   e.Schema,
+				Codec:    e.Codec,
+				Data:     e.Data,
+				Created:  e.Created,
+				Metadata: e.Metadata,
+				Position: p,
+			}); err != nil {
+				return err
+			}
+
+			if err := b.Put(key(e.Version), v); err != nil {
+				return err
+			}
+
+			ps[i] = p
+		}
+
+		v, err := json.Marshal(aggregate{Type: a.Type, Version: a.Version})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(aggregates).Put(id, v); err != nil {
+			return err
+		}
+
+		t, err := tx.Bucket(types).CreateBucketIfNotExists([]byte(a.Type))
+		if err != nil {
+			return err
+		}
+
+		return t.Put(id, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range es {
+		es[i].Position = ps[i]
+	}
+
+	return nil
+}
+
+func (s *Store) Load(ctx context.Context, id string) (cqrs.CQRSAggregate, error) {
+	if err := ctx.Err(); err != nil {
+		return cqrs.CQRSAggregate{}, err
+	}
+
+	var a aggregate
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var ok bool
+		var err error
+		if a, ok, err = load(tx, []byte(id)); err != nil {
+			return err
+		}
+
+		if !ok {
+			return fmt.Errorf("aggregate %s not found", id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return cqrs.CQRSAggregate{}, err
+	}
+
+	return cqrs.CQRSAggregate{ID: id, Type: a.Type, Version: a.Version}, nil
+}
+
+func (s *Store) Events(ctx context.Context, version uint64, id string) ([]cqrs.Event, error) {
+	var es []cqrs.Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(events).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(key(version + 1)); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var e entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+
+			es = append(es, e.event(binary.BigEndian.Uint64(k)))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+func (s *Store) ReadAll(ctx context.Context, position uint64, limit int, f cqrs.Filter) ([]cqrs.Record, error) {
+	var rs []cqrs.Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(all).Cursor()
+		for k, v := c.Seek(key(position + 1)); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if limit > 0 && len(rs) == limit {
+				return nil
+			}
+
+			var p pointer
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+
+			if !f.Match(p.Type, p.AggregateType) {
+				continue
+			}
+
+			var e entry
+			b := tx.Bucket(events).Bucket([]byte(p.Aggregate))
+			if err := json.Unmarshal(b.Get(key(p.Version)), &e); err != nil {
+				return err
+			}
+
+			rs = append(rs, cqrs.Record{
+				Event: e.event(p.Version),
+				Aggregate: cqrs.CQRSAggregate{
+					ID:      p.Aggregate,
+					Type:    p.AggregateType,
+					Version: p.Version,
+				},
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (s *Store) Last(ctx context.Context, kind string, frequency uint) ([]cqrs.CQRSAggregate, error) {
+	var o []cqrs.CQRSAggregate
+	err := s.db.View(func(tx *bolt.Tx) error {
+		t := tx.Bucket(types).Bucket([]byte(kind))
+		if t == nil {
+			return nil
+		}
+
+		return t.ForEach(func(id, _ []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			a, _, err := load(tx, id)
+			if err != nil {
+				return err
+			}
+
+			var n snapshot
+			if v := tx.Bucket(snapshots).Get(id); v != nil {
+				if err := json.Unmarshal(v, &n); err != nil {
+					return err
+				}
+			}
+
+			if uint(a.Version-n.Version) < frequency {
+				return nil
+			}
+
+			o = append(o, cqrs.CQRSAggregate{
+				ID:      string(id),
+				Version: n.Version,
+				Type:    a.Type,
+			})
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (s *Store) Make(ctx context.Context, n cqrs.Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(snapshot{Version: n.Version, Data: n.Data})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshots).Put([]byte(n.AggregateID), v)
+	})
+}
+
+func (s *Store) Snapshot(ctx context.Context, id string) (uint64, []byte) {
+	var n snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(snapshots).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		return json.Unmarshal(v, &n)
+	})
+	if err != nil {
+		log.Error("boltstore.snapshot", err)
+		return 0, []byte{}
+	}
+
+	if n.Data == nil {
+		return 0, []byte{}
+	}
+
+	return n.Version, n.Data
+}
+
+// load returns aggregate and tells if it exists.
+func load(tx *bolt.Tx, id []byte) (aggregate, bool, error) {
+	var a aggregate
+	v := tx.Bucket(aggregates).Get(id)
+	if v == nil {
+		return a, false, nil
+	}
+
+	return a, true, json.Unmarshal(v, &a)
+}
+
+// key of event, big-endian keeps versions sorted.
+func key(version uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, version)
+
+	return k
+}
@@ -0,0 +1,79 @@
+package boltstore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sokool/cqrsexample/boltstore"
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/cqrs/storetest"
+	"github.com/sokool/gokit/test/is"
+)
+
+var ctx = context.Background()
+
+func open(t *testing.T) (*boltstore.Store, string) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	is.NotErr(t, err)
+
+	s, err := boltstore.Open(filepath.Join(dir, "lunch.db"))
+	is.NotErr(t, err)
+
+	return s, dir
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (cqrs.Store, func()) {
+		s, dir := open(t)
+
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestReopen(t *testing.T) {
+	s, dir := open(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I save events and reopen store
+	is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 1, 4))
+	expected, err := s.Events(ctx, 0, storetest.ID)
+	is.NotErr(t, err)
+	is.NotErr(t, s.Close())
+
+	s, err = boltstore.Open(filepath.Join(dir, "lunch.db"))
+	is.NotErr(t, err)
+	defer s.Close()
+
+	//I EXPECT same events and aggregate
+	es, err := s.Events(ctx, 0, storetest.ID)
+	is.NotErr(t, err)
+	is.Equal(t, expected, es)
+
+	a, err := s.Load(ctx, storetest.ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(4), a.Version)
+}
+
+func TestFailedSave(t *testing.T) {
+	s, dir := open(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	//WHEN I save events of aggregate without type, which bolt rejects
+	es := storetest.Events(storetest.ID, 1, 2)
+	a := cqrs.CQRSAggregate{ID: storetest.ID, Version: 2}
+	is.Err(t, s.Save(ctx, a, es), "bucket name required")
+
+	//I EXPECT events without position and nothing stored
+	is.Equal(t, uint64(0), es[0].Position)
+	is.Equal(t, uint64(0), es[1].Position)
+	rs, err := s.Events(ctx, 0, storetest.ID)
+	is.NotErr(t, err)
+	is.Equal(t, 0, len(rs))
+}
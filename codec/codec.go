@@ -0,0 +1,37 @@
+// Package codec provides cqrs.Codec implementations for restaurant events,
+// pick one with cqrs.Codecs option passed to cqrsexample.NewService.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+var (
+	JSON                   = cqrs.JSON
+	Gob         cqrs.Codec = gobCodec{}
+	MessagePack cqrs.Codec = msgpackCodec{}
+	Protobuf    cqrs.Codec = protobufCodec{}
+)
+
+// All codecs, useful for reading streams written in mixed formats.
+var All = []cqrs.Codec{JSON, Gob, MessagePack, Protobuf}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
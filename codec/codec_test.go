@@ -0,0 +1,122 @@
+package codec_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sokool/cqrsexample/codec"
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/gokit/test/is"
+)
+
+var at = time.Date(2018, 3, 5, 12, 30, 15, 123456789, time.Local)
+
+var samples = []interface{}{
+	&events.Created{Restaurant: "Zdrowe Gary", Info: "polskie jedzenie", Menu: []string{"Ogórkowa", "Schabowy", "Pierogi"}, At: at},
+	&events.Created{Restaurant: "Pusta", At: at},
+	&events.Scheduled{On: at.AddDate(0, 0, 2)},
+	&events.Rescheduled{On: at.AddDate(0, 0, 3)},
+	&events.MealSelected{Person: "Tom", Meal: "Pierogi", At: at},
+	&events.MealChanged{Person: "Tom", PreviousMeal: "Pierogi", NewMeal: "Schabowy", At: at},
+	&events.Scheduled{},
+	&events.Canceled{Reason: "closed for holidays", At: at},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range codec.All {
+		for _, s := range samples {
+			data, err := c.Marshal(s)
+			is.NotErr(t, err)
+
+			v := reflect.New(reflect.TypeOf(s).Elem()).Interface()
+			is.NotErr(t, c.Unmarshal(data, v))
+
+			// times might differ in location, so they are compared in JSON
+			exp, _ := json.Marshal(s)
+			got, _ := json.Marshal(v)
+			is.True(t, bytes.Equal(exp, got), "%s:\n\texp: %s\n\tgot: %s",
+				c.Name(), exp, got)
+		}
+	}
+}
+
+func TestMessagePackFormat(t *testing.T) {
+	data, err := codec.MessagePack.Marshal(&events.MealSelected{
+		Person: "Tom",
+		Meal:   "BBQ",
+		At:     time.Unix(1, 0),
+	})
+
+	is.NotErr(t, err)
+	is.Equal(t, []byte{
+		0x83,
+		0xa6, 'P', 'e', 'r', 's', 'o', 'n', 0xa3, 'T', 'o', 'm',
+		0xa4, 'M', 'e', 'a', 'l', 0xa3, 'B', 'B', 'Q',
+		0xa2, 'A', 't', 0xd6, 0xff, 0, 0, 0, 1,
+	}, data)
+}
+
+func TestProtobufFormat(t *testing.T) {
+	data, err := codec.Protobuf.Marshal(&events.MealSelected{
+		Person: "Tom",
+		Meal:   "BBQ",
+		At:     time.Unix(150, 0),
+	})
+
+	is.NotErr(t, err)
+	is.Equal(t, []byte{
+		0x0a, 3, 'T', 'o', 'm',
+		0x12, 3, 'B', 'B', 'Q',
+		0x1a, 3, 0x08, 0x96, 0x01,
+	}, data)
+
+	// fields unknown to MealSelected (ie. added later) are skipped
+	var e events.MealSelected
+	is.NotErr(t, codec.Protobuf.Unmarshal(append(data, 0x20, 0x01), &e))
+	is.Equal(t, "BBQ", e.Meal)
+}
+
+func TestProtobufFieldNumbers(t *testing.T) {
+	//WHEN I marshal struct with field without number
+	_, err := codec.Protobuf.Marshal(&struct {
+		Person string `protobuf:"1"`
+		Meal   string
+	}{})
+
+	//I EXPECT error
+	is.Err(t, err, "no field number")
+
+	//WHEN I marshal struct with fields declared out of number order
+	data, err := codec.Protobuf.Marshal(&struct {
+		Meal   string `protobuf:"2"`
+		Person string `protobuf:"1"`
+	}{Meal: "BBQ", Person: "Tom"})
+
+	//I EXPECT them encoded by number, so MealSelected reads them
+	is.NotErr(t, err)
+	var e events.MealSelected
+	is.NotErr(t, codec.Protobuf.Unmarshal(data, &e))
+	is.Equal(t, "Tom", e.Person)
+	is.Equal(t, "BBQ", e.Meal)
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B)        { benchmarkUnmarshal(codec.JSON, b) }
+func BenchmarkUnmarshalGob(b *testing.B)         { benchmarkUnmarshal(codec.Gob, b) }
+func BenchmarkUnmarshalMessagePack(b *testing.B) { benchmarkUnmarshal(codec.MessagePack, b) }
+func BenchmarkUnmarshalProtobuf(b *testing.B)    { benchmarkUnmarshal(codec.Protobuf, b) }
+
+func benchmarkUnmarshal(c interface {
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte, interface{}) error
+}, b *testing.B) {
+	data, err := c.Marshal(samples[5])
+	is.Ok(b, err)
+
+	for n := 0; n < b.N; n++ {
+		var e events.MealChanged
+		is.Ok(b, c.Unmarshal(data, &e))
+	}
+}
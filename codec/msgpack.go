@@ -0,0 +1,18 @@
+package codec
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// msgpackCodec encodes values as MessagePack (https://msgpack.org) with
+// github.com/vmihailenco/msgpack. Structs are encoded as maps keyed by
+// field names and time.Time as timestamp extension (type -1).
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,306 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufCodec encodes structs in protocol buffers wire format with
+// google.golang.org/protobuf/encoding/protowire. Every exported field has
+// to carry its number in `protobuf:"N"` tag, so numbers never depend on
+// order of fields, see events/events.proto for messages of restaurant
+// events. time.Time is encoded as google.protobuf.Timestamp.
+type protobufCodec struct{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf: %T is not a struct", v)
+	}
+
+	return protoMessage(nil, rv)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf: unmarshal expects pointer to struct, got %T", v)
+	}
+
+	return protoUnmarshal(data, rv.Elem())
+}
+
+// protoFields maps field numbers of struct t to indexes of its fields. Every
+// exported field has to be numbered.
+func protoFields(t reflect.Type) (map[protowire.Number]int, error) {
+	fs := map[protowire.Number]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag, ok := f.Tag.Lookup("protobuf")
+		if !ok {
+			return nil, fmt.Errorf("protobuf: %s.%s has no field number tag", t, f.Name)
+		}
+
+		n, err := strconv.Atoi(tag)
+		if err != nil || !protowire.Number(n).IsValid() {
+			return nil, fmt.Errorf("protobuf: %s.%s has invalid field number %q", t, f.Name, tag)
+		}
+
+		if j, ok := fs[protowire.Number(n)]; ok {
+			return nil, fmt.Errorf("protobuf: %s.%s and %s have same field number %d",
+				t, f.Name, t.Field(j).Name, n)
+		}
+
+		fs[protowire.Number(n)] = i
+	}
+
+	return fs, nil
+}
+
+func protoMessage(b []byte, v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if s := t.Unix(); s != 0 {
+			b = protowire.AppendTag(b, 1, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(s))
+		}
+		if n := t.Nanosecond(); n != 0 {
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(n))
+		}
+		return b, nil
+	}
+
+	fs, err := protoFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	// fields are written in order of their numbers, as protoc does.
+	ns := make([]protowire.Number, 0, len(fs))
+	for n := range fs {
+		ns = append(ns, n)
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i] < ns[j] })
+
+	for _, n := range ns {
+		i := fs[n]
+		if b, err = protoField(b, n, v.Field(i)); err != nil {
+			return nil, fmt.Errorf("protobuf: %s.%s: %s",
+				v.Type(), v.Type().Field(i).Name, err)
+		}
+	}
+
+	return b, nil
+}
+
+// protoField appends field with number n, zero values are omitted as
+// in proto3.
+func protoField(b []byte, n protowire.Number, v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		if v.Interface().(time.Time).IsZero() {
+			return b, nil
+		}
+		return protoEmbedded(b, n, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			b = protowire.AppendTag(b, n, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() != 0 {
+			b = protowire.AppendTag(b, n, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v.Int()))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() != 0 {
+			b = protowire.AppendTag(b, n, protowire.VarintType)
+			b = protowire.AppendVarint(b, v.Uint())
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if v.Float() != 0 {
+			b = protowire.AppendTag(b, n, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v.Float()))
+		}
+
+	case reflect.String:
+		if v.Len() != 0 {
+			b = protowire.AppendTag(b, n, protowire.BytesType)
+			b = protowire.AppendString(b, v.String())
+		}
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() != 0 {
+				b = protowire.AppendTag(b, n, protowire.BytesType)
+				b = protowire.AppendBytes(b, v.Bytes())
+			}
+			return b, nil
+		}
+
+		// repeated fields, scalars are not packed so every element
+		// is written with its own tag, which is valid for any decoder.
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			if e.Kind() == reflect.Struct {
+				var err error
+				if b, err = protoEmbedded(b, n, e); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if e.Kind() == reflect.String {
+				b = protowire.AppendTag(b, n, protowire.BytesType)
+				b = protowire.AppendString(b, e.String())
+				continue
+			}
+
+			return nil, fmt.Errorf("repeated %s is not supported", e.Type())
+		}
+
+	case reflect.Struct:
+		return protoEmbedded(b, n, v)
+
+	default:
+		return nil, fmt.Errorf("%s is not supported", v.Type())
+	}
+
+	return b, nil
+}
+
+func protoEmbedded(b []byte, n protowire.Number, v reflect.Value) ([]byte, error) {
+	m, err := protoMessage(nil, v)
+	if err != nil {
+		return nil, err
+	}
+
+	b = protowire.AppendTag(b, n, protowire.BytesType)
+
+	return protowire.AppendBytes(b, m), nil
+}
+
+func protoUnmarshal(b []byte, v reflect.Value) error {
+	var fs map[protowire.Number]int
+	var sec, nsec int64
+	isTime := v.Type() == timeType
+	if !isTime {
+		var err error
+		if fs, err = protoFields(v.Type()); err != nil {
+			return err
+		}
+	}
+
+	for len(b) > 0 {
+		n, wire, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return fmt.Errorf("protobuf: %s", protowire.ParseError(l))
+		}
+		b = b[l:]
+
+		var u uint64
+		var p []byte
+		switch wire {
+		case protowire.VarintType:
+			u, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			u, l = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var u32 uint32
+			u32, l = protowire.ConsumeFixed32(b)
+			u = uint64(u32)
+		case protowire.BytesType:
+			p, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(n, wire, b)
+		}
+		if l < 0 {
+			return fmt.Errorf("protobuf: field %d: %s", n, protowire.ParseError(l))
+		}
+		b = b[l:]
+
+		if isTime {
+			switch n {
+			case 1:
+				sec = int64(u)
+			case 2:
+				nsec = int64(u)
+			}
+			continue
+		}
+
+		// unknown fields are skipped, so older code reads newer data.
+		i, ok := fs[n]
+		if !ok {
+			continue
+		}
+
+		if err := protoSet(v.Field(i), u, p); err != nil {
+			return fmt.Errorf("protobuf: %s.%s: %s",
+				v.Type(), v.Type().Field(i).Name, err)
+		}
+	}
+
+	if isTime {
+		v.Set(reflect.ValueOf(time.Unix(sec, nsec)))
+	}
+
+	return nil
+}
+
+// protoSet sets field f from varint or fixed value u, or bytes p.
+func protoSet(f reflect.Value, u uint64, p []byte) error {
+	if f.Type() == timeType {
+		return protoUnmarshal(p, f)
+	}
+
+	switch f.Kind() {
+	case reflect.Bool:
+		f.SetBool(u != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.SetInt(int64(u))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f.SetFloat(math.Float64frombits(u))
+	case reflect.String:
+		f.SetString(string(p))
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.Uint8 {
+			f.SetBytes(append([]byte{}, p...))
+			return nil
+		}
+
+		e := reflect.New(f.Type().Elem()).Elem()
+		if err := protoSet(e, u, p); err != nil {
+			return err
+		}
+		f.Set(reflect.Append(f, e))
+	case reflect.Struct:
+		return protoUnmarshal(p, f)
+	default:
+		return fmt.Errorf("%s is not supported", f.Type())
+	}
+
+	return nil
+}
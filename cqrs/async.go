@@ -0,0 +1,290 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sokool/gokit/log"
+)
+
+// Async runs handler on its own goroutines, so slow or panicking handler
+// does not hold back or break Save. Events are put into bounded queues of
+// workers, events of one aggregate always go to the same worker, so they
+// are handled in order they were saved.
+type Async struct {
+	handler ContextHandlerFunc
+	queues  []chan batch
+	done    sync.WaitGroup
+
+	// saving orders Save of stores given by AsyncHandler, so positions
+	// are queued in order they were assigned.
+	saving sync.Mutex
+
+	mu       sync.Mutex
+	changed  chan struct{} // closed and replaced when position changes
+	inflight map[uint64]time.Time
+	seen     uint64 // last queued position
+	panics   int
+
+	// events of aggregate are sent to its worker in turns they were saved
+	// in, turn is given by first position of events.
+	turn  *sync.Cond
+	turns map[uint64]uint64
+	next  map[string]uint64 // turn of next saved events of aggregate
+	sent  map[string]uint64 // turn of events to send to worker next
+}
+
+type batch struct {
+	ctx       context.Context
+	aggregate CQRSAggregate
+	events    []Event
+	data      []interface{}
+}
+
+type AsyncOption func(*asyncOptions)
+
+type asyncOptions struct {
+	workers int
+	queue   int
+}
+
+// Workers handling events, default is 4.
+func Workers(n int) AsyncOption {
+	return func(o *asyncOptions) {
+		o.workers = n
+	}
+}
+
+// QueueSize of every worker, Handle blocks when queue of worker is full.
+// Default is 256.
+func QueueSize(n int) AsyncOption {
+	return func(o *asyncOptions) {
+		o.queue = n
+	}
+}
+
+// NewAsync starts workers of h, returned Async is meant to be registered
+// with AsyncHandler.
+func NewAsync(h ContextHandlerFunc, os ...AsyncOption) *Async {
+	o := asyncOptions{workers: 4, queue: 256}
+	for _, fn := range os {
+		fn(&o)
+	}
+
+	a := &Async{
+		handler:  h,
+		queues:   make([]chan batch, o.workers),
+		changed:  make(chan struct{}),
+		inflight: map[uint64]time.Time{},
+		turns:    map[uint64]uint64{},
+		next:     map[string]uint64{},
+		sent:     map[string]uint64{},
+	}
+	a.turn = sync.NewCond(&a.mu)
+
+	for i := range a.queues {
+		a.queues[i] = make(chan batch, o.queue)
+		a.done.Add(1)
+		go a.work(a.queues[i])
+	}
+
+	return a
+}
+
+// AsyncHandler registers Handle of a as event handler of repository and
+// wraps its storage, so positions of saved events are known to a before
+// Save of next events. Otherwise WaitFor could pass position of events
+// which are stored, but not queued yet, when they are saved concurrently.
+// It has to be given after Storage option.
+func AsyncHandler(a *Async) Option {
+	return func(o *Options) {
+		if o.Storage == nil {
+			o.Storage = NewMemoryStorage()
+		}
+		o.Storage = &asyncStore{Store: o.Storage, async: a}
+
+		EventContextHandler(a.Handle)(o)
+	}
+}
+
+type asyncStore struct {
+	Store
+	async *Async
+}
+
+func (s *asyncStore) Save(ctx context.Context, a CQRSAggregate, es []Event) error {
+	s.async.saving.Lock()
+	defer s.async.saving.Unlock()
+
+	if err := s.Store.Save(ctx, a, es); err != nil {
+		return err
+	}
+
+	s.async.queue(a.ID, es)
+
+	return nil
+}
+
+// Handle queues events for handler, it blocks when queue is full, as
+// events are already stored and can not be dropped, and until events of
+// the same aggregate saved before are queued. Handler gets ctx without its
+// cancellation, since it runs after command is done.
+func (a *Async) Handle(ctx context.Context, ag CQRSAggregate, es []Event, ds []interface{}) {
+	if len(es) == 0 {
+		return
+	}
+
+	a.queue(ag.ID, es)
+
+	a.mu.Lock()
+	t := a.turns[es[0].Position]
+	for a.sent[ag.ID] != t {
+		a.turn.Wait()
+	}
+	delete(a.turns, es[0].Position)
+	a.mu.Unlock()
+
+	h := fnv.New32a()
+	h.Write([]byte(ag.ID))
+	a.queues[h.Sum32()%uint32(len(a.queues))] <- batch{context.WithoutCancel(ctx), ag, es, ds}
+
+	a.mu.Lock()
+	if a.sent[ag.ID]++; a.sent[ag.ID] == a.next[ag.ID] {
+		delete(a.sent, ag.ID)
+		delete(a.next, ag.ID)
+	}
+	a.turn.Broadcast()
+	a.mu.Unlock()
+}
+
+// queue marks events of aggregate as waiting for handler and gives them
+// turn, unless they already are.
+func (a *Async) queue(aggregate string, es []Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(es) == 0 {
+		return
+	}
+
+	if _, ok := a.inflight[es[0].Position]; ok {
+		return
+	}
+
+	a.inflight[es[0].Position] = time.Now()
+	if p := es[len(es)-1].Position; p > a.seen {
+		a.seen = p
+	}
+
+	a.turns[es[0].Position] = a.next[aggregate]
+	a.next[aggregate]++
+}
+
+func (a *Async) work(q chan batch) {
+	defer a.done.Done()
+
+	for b := range q {
+		a.handle(b)
+
+		a.mu.Lock()
+		delete(a.inflight, b.events[0].Position)
+		close(a.changed)
+		a.changed = make(chan struct{})
+		a.mu.Unlock()
+	}
+}
+
+// handle isolates panic of handler, events which caused it are skipped.
+func (a *Async) handle(b batch) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("cqrs.async.handle", fmt.Errorf("aggregate %s: %v", b.aggregate.ID, r))
+
+			a.mu.Lock()
+			a.panics++
+			a.mu.Unlock()
+		}
+	}()
+
+	a.handler(b.ctx, b.aggregate, b.events, b.data)
+}
+
+// Position up to which every queued event has been handled.
+func (a *Async) Position() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.position()
+}
+
+func (a *Async) position() uint64 {
+	p := a.seen
+	for first := range a.inflight {
+		if first-1 < p {
+			p = first - 1
+		}
+	}
+
+	return p
+}
+
+// WaitFor blocks until events at and before given position are handled,
+// ie. caller reads its own writes, when it waits for position of aggregate
+// Root after Save.
+func (a *Async) WaitFor(ctx context.Context, position uint64) error {
+	for {
+		a.mu.Lock()
+		p, changed := a.position(), a.changed
+		a.mu.Unlock()
+
+		if p >= position {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// AsyncStats tells how far behind saved events handler is.
+type AsyncStats struct {
+	Lag    uint64        // number of positions queued, but not handled yet
+	Delay  time.Duration // how long oldest queued events wait
+	Queued int           // number of queued batches of events
+	Panics int           // number of batches which handler panicked on
+}
+
+func (a *Async) Stats() AsyncStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := AsyncStats{
+		Lag:    a.seen - a.position(),
+		Queued: len(a.inflight),
+		Panics: a.panics,
+	}
+
+	for _, t := range a.inflight {
+		if d := time.Since(t); d > s.Delay {
+			s.Delay = d
+		}
+	}
+
+	return s
+}
+
+// Close waits until queued events are handled and stops workers, Handle
+// must not be called afterwards.
+func (a *Async) Close() {
+	for _, q := range a.queues {
+		close(q)
+	}
+
+	a.done.Wait()
+}
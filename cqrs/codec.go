@@ -0,0 +1,43 @@
+package cqrs
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec serializes event data. Name of codec is stored with every event,
+// so events written by different codecs might be loaded from one stream.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSON is default Codec, events stored before codecs were introduced are
+// treated as JSON.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// Codecs tells repository to write events with c, events stored with any
+// of read codecs (and c, and JSON) are loadable.
+func Codecs(c Codec, read ...Codec) Option {
+	return func(o *Options) {
+		if o.Codecs == nil {
+			o.Codecs = map[string]Codec{}
+		}
+
+		for _, r := range append(read, c) {
+			if x, ok := o.Codecs[r.Name()]; ok && x != r {
+				panic(fmt.Sprintf("cqrs: codec %s registered twice", r.Name()))
+			}
+			o.Codecs[r.Name()] = r
+		}
+
+		o.Codec = c
+	}
+}
@@ -0,0 +1,209 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sokool/gokit/log"
+)
+
+// ErrorHandlerFunc tells when it failed to handle events, see Retry.
+type ErrorHandlerFunc func(context.Context, CQRSAggregate, []Event, []interface{}) error
+
+// DeadLetter keeps events which handler failed to handle, until they are
+// redelivered or discarded.
+type DeadLetter struct {
+	ID        string
+	Handler   string
+	Aggregate CQRSAggregate
+	Events    []Event
+	Error     string
+	Attempts  int
+	Failed    time.Time
+}
+
+// DeadLetters store events which handlers failed to handle.
+type DeadLetters interface {
+	Put(ctx context.Context, l DeadLetter) error
+	// List dead letters of handler ordered by time of failure, empty
+	// handler lists all of them.
+	List(ctx context.Context, handler string) ([]DeadLetter, error)
+	Get(ctx context.Context, id string) (DeadLetter, error)
+	// Delete discards dead letter.
+	Delete(ctx context.Context, id string) error
+}
+
+type RetryOption func(*retry)
+
+type retry struct {
+	attempts   int
+	first, max time.Duration
+}
+
+// Attempts of handling events, before they go to dead letters. Default
+// is 3.
+func Attempts(n int) RetryOption {
+	return func(r *retry) {
+		r.attempts = n
+	}
+}
+
+// Backoff between attempts, it starts with first and doubles up to max.
+// Default is 100ms up to 5s.
+func Backoff(first, max time.Duration) RetryOption {
+	return func(r *retry) {
+		r.first, r.max = first, max
+	}
+}
+
+// Retry calls h until it handles events or attempts are used up, then
+// events and last error are put into d under name of handler. Retries are
+// stopped when ctx is done. As handler registered with
+// EventContextHandler holds back Save while it retries, it suits Async or
+// Subscription better.
+func Retry(name string, h ErrorHandlerFunc, d DeadLetters, os ...RetryOption) ContextHandlerFunc {
+	r := retry{attempts: 3, first: 100 * time.Millisecond, max: 5 * time.Second}
+	for _, fn := range os {
+		fn(&r)
+	}
+
+	return func(ctx context.Context, a CQRSAggregate, es []Event, ds []interface{}) {
+		var err error
+		var n int
+		wait := r.first
+	attempts:
+		for n = 1; ; n++ {
+			if err = h(ctx, a, es, ds); err == nil {
+				return
+			}
+
+			log.Error("cqrs.retry."+name, fmt.Errorf("attempt %d: %s", n, err))
+			if n >= r.attempts {
+				break
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				break attempts
+			}
+
+			if wait *= 2; wait > r.max {
+				wait = r.max
+			}
+		}
+
+		l := DeadLetter{
+			ID:        generateID(),
+			Handler:   name,
+			Aggregate: a,
+			Events:    es,
+			Error:     err.Error(),
+			Attempts:  n,
+			Failed:    time.Now(),
+		}
+
+		// events are put even when ctx of command is done.
+		if err := d.Put(context.Background(), l); err != nil {
+			log.Error("cqrs.retry."+name, fmt.Errorf("dead letter %s: %s", l.ID, err))
+		}
+	}
+}
+
+// Redeliver events of dead letter to h, dead letter is deleted when h
+// handles them, otherwise its error and attempts are updated.
+func (r *Repository) Redeliver(ctx context.Context, d DeadLetters, id string, h ErrorHandlerFunc) error {
+	l, err := d.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	ds := make([]interface{}, len(l.Events))
+	for i, e := range l.Events {
+		if ds[i], err = r.Decode(e); err != nil {
+			return err
+		}
+	}
+
+	if err := h(ctx, l.Aggregate, l.Events, ds); err != nil {
+		l.Error, l.Attempts, l.Failed = err.Error(), l.Attempts+1, time.Now()
+		if perr := d.Put(ctx, l); perr != nil {
+			return perr
+		}
+
+		return err
+	}
+
+	return d.Delete(ctx, id)
+}
+
+type memDeadLetters struct {
+	mu      sync.Mutex
+	letters map[string]DeadLetter
+}
+
+// NewMemoryDeadLetters keeps dead letters in memory.
+func NewMemoryDeadLetters() DeadLetters {
+	return &memDeadLetters{letters: map[string]DeadLetter{}}
+}
+
+func (m *memDeadLetters) Put(ctx context.Context, l DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.letters[l.ID] = l
+	return nil
+}
+
+func (m *memDeadLetters) List(ctx context.Context, handler string) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ls := []DeadLetter{}
+	for _, l := range m.letters {
+		if handler == "" || l.Handler == handler {
+			ls = append(ls, l)
+		}
+	}
+	SortDeadLetters(ls)
+
+	return ls, nil
+}
+
+func (m *memDeadLetters) Get(ctx context.Context, id string) (DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.letters[id]
+	if !ok {
+		return DeadLetter{}, fmt.Errorf("dead letter %s not found", id)
+	}
+
+	return l, nil
+}
+
+func (m *memDeadLetters) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.letters[id]; !ok {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+
+	delete(m.letters, id)
+	return nil
+}
+
+// SortDeadLetters by time of failure, as DeadLetters.List expects.
+func SortDeadLetters(ls []DeadLetter) {
+	sort.Slice(ls, func(i, j int) bool {
+		if !ls[i].Failed.Equal(ls[j].Failed) {
+			return ls[i].Failed.Before(ls[j].Failed)
+		}
+
+		return ls[i].ID < ls[j].ID
+	})
+}
@@ -35,21 +35,40 @@ func (i structure) Instance() interface{} {
 	return reflect.New(i.Type).Interface()
 }
 
+// Named is implemented by events which are stored under explicit name,
+// so Go type might be renamed or moved to another package without
+// orphaning already stored events. Events which are not Named are stored
+// under their Go struct name.
+type Named interface {
+	EventName() string
+}
+
 func newStructure(v interface{}) structure {
 	t := reflect.TypeOf(v)
 	if t.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
 
+	if n, ok := reflect.New(t).Interface().(Named); ok {
+		return structure{n.EventName(), t}
+	}
+
 	return structure{t.Name(), t}
 }
 
 type Event struct {
-	ID      string
-	Type    string
-	Data    []byte
-	Version uint64
-	Created time.Time
+	ID       string
+	Type     string
+	Schema   uint
+	Codec    string
+	Data     []byte
+	Version  uint64
+	Created  time.Time
+	Metadata Metadata
+
+	// Position in global log of all aggregates, it is assigned by Store
+	// when event is saved.
+	Position uint64
 }
 
 func (e Event) String() string {
@@ -57,13 +76,20 @@ func (e Event) String() string {
 		e.ID[24:], e.Version, e.Type, e.Data)
 }
 
-//todo Root == CQRSAggregate???
+// todo Root == CQRSAggregate???
 type Root struct {
 	ID      string
 	Version uint64
 	Type    string
 	events  []interface{}
 	handler func(interface{}) error
+
+	// Position in global log of last event saved by repository.
+	Position uint64
+
+	// historical aggregates (loaded at given version or time) can not
+	// be saved.
+	readOnly bool
 }
 
 func (a *Root) init(id string, version uint64) {
@@ -81,6 +107,12 @@ func (a *Root) Apply(e interface{}) error {
 	return nil
 }
 
+// ReadOnly tells if aggregate has been loaded from the past and can not
+// be saved.
+func (a *Root) ReadOnly() bool {
+	return a.readOnly
+}
+
 func (a *Root) String() string {
 	return fmt.Sprintf("#%s: v%d.%s", a.ID[24:], a.Version, a.Type)
 }
@@ -92,7 +124,7 @@ func newRoot(h DataHandler, name string) *Root {
 	}
 }
 
-//todo maybe interface?
+// todo maybe interface?
 type CQRSAggregate struct {
 	ID      string
 	Type    string
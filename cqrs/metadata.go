@@ -0,0 +1,58 @@
+package cqrs
+
+import "context"
+
+// Well known Metadata keys.
+const (
+	// Actor is user or system which issued command.
+	Actor = "actor"
+	// CorrelationID groups all events which appeared in one business
+	// transaction, ie. single http request.
+	CorrelationID = "correlation_id"
+	// CausationID is ID of event or request which caused command.
+	CausationID = "causation_id"
+	// Source is name of application or integration which issued command.
+	Source = "source"
+)
+
+// Metadata is stored alongside every event of saved aggregate.
+type Metadata map[string]string
+
+func (m Metadata) copy() Metadata {
+	c := make(Metadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns context with key set to value, Metadata of events
+// saved with that context contains it.
+func WithMetadata(ctx context.Context, key, value string) context.Context {
+	m := MetadataFrom(ctx)
+	m[key] = value
+
+	return context.WithValue(ctx, metadataKey{}, m)
+}
+
+// MetadataFrom returns copy of Metadata carried by ctx.
+func MetadataFrom(ctx context.Context) Metadata {
+	m, _ := ctx.Value(metadataKey{}).(Metadata)
+
+	return m.copy()
+}
+
+// CausedBy returns context for command issued as a reaction on event e,
+// causation is set to e and correlation is inherited from e.
+func CausedBy(ctx context.Context, e Event) context.Context {
+	correlation := e.Metadata[CorrelationID]
+	if correlation == "" {
+		correlation = e.ID
+	}
+
+	ctx = WithMetadata(ctx, CausationID, e.ID)
+	return WithMetadata(ctx, CorrelationID, correlation)
+}
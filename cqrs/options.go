@@ -1,5 +1,10 @@
 package cqrs
 
+import (
+	"context"
+	"fmt"
+)
+
 // todo: custom logger implementation
 // todo: custom id generator - separate for events and aggregator?
 //		 do I need id for event since I have uint Version?
@@ -11,11 +16,19 @@ package cqrs
 // for external use ie. another aggregate
 type HandlerFunc func(CQRSAggregate, []Event, []interface{})
 
+// ContextHandlerFunc receives context of the command which produced
+// events, so request scoped values (user, trace id) reach listeners.
+type ContextHandlerFunc func(context.Context, CQRSAggregate, []Event, []interface{})
+
 type Options struct {
-	Handlers []HandlerFunc
-	Storage  Store
-	Name     string
-	Snapshot int
+	Handlers  []ContextHandlerFunc
+	Upcasters map[string]map[uint]Upcaster
+	Aliases   map[string]string
+	Codec     Codec
+	Codecs    map[string]Codec
+	Storage   Store
+	Name      string
+	Snapshot  int
 }
 
 type Option func(*Options)
@@ -51,9 +64,16 @@ func Storage(s Store) Option {
 //}
 
 func EventHandler(fn HandlerFunc) Option {
+	return EventContextHandler(
+		func(_ context.Context, a CQRSAggregate, es []Event, ds []interface{}) {
+			fn(a, es, ds)
+		})
+}
+
+func EventContextHandler(fn ContextHandlerFunc) Option {
 	return func(o *Options) {
 		if o.Handlers == nil {
-			o.Handlers = []HandlerFunc{}
+			o.Handlers = []ContextHandlerFunc{}
 		}
 
 		o.Handlers = append(o.Handlers, fn)
@@ -78,6 +98,23 @@ func EventHandler(fn HandlerFunc) Option {
 //	}
 //}
 
+// Alias lets events stored under legacy name to be loaded as event
+// registered under name.
+func Alias(legacy, name string) Option {
+	return func(o *Options) {
+		if o.Aliases == nil {
+			o.Aliases = map[string]string{}
+		}
+
+		if n, ok := o.Aliases[legacy]; ok && n != name {
+			panic(fmt.Sprintf("cqrs: alias %s points to %s and %s",
+				legacy, n, name))
+		}
+
+		o.Aliases[legacy] = name
+	}
+}
+
 func newOptions(ops ...Option) *Options {
 	s := &Options{}
 
@@ -0,0 +1,304 @@
+// Package cqrs is the event sourcing core of this example. It started as
+// github.com/sokool/gokit/cqrs and lives here, as the example extends it.
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sokool/gokit/log"
+)
+
+type Repository struct {
+	name        string
+	serializer  *serializer
+	factory     Factory
+	opts        *Options
+	snapshotter *Snapshotter
+
+	mu            sync.Mutex
+	subscriptions []*Subscription
+}
+
+func (s *Repository) Aggregate() Aggregate {
+	return s.aggregateInstance("", 0)
+}
+
+func (s *Repository) Save(a Aggregate) error {
+	return s.SaveContext(context.Background(), a)
+}
+
+// SaveContext stores aggregate events, ctx is passed to the storage and to
+// every registered event handler.
+func (s *Repository) SaveContext(ctx context.Context, a Aggregate) error {
+	var r *Root = a.Root()
+	if r.readOnly {
+		return fmt.Errorf("%s is read only, it has been loaded from the past",
+			r.String())
+	}
+
+	var events []Event
+	var metadata = MetadataFrom(ctx)
+	var aggregate = CQRSAggregate{
+		ID:      r.ID,
+		Type:    s.name,
+		Version: r.Version,
+	}
+
+	if len(aggregate.ID) == 0 {
+		aggregate.ID = generateID()
+	}
+
+	log.Info("cqrs.save.aggregate", "%s with %d new events",
+		aggregate.String(), len(r.events))
+
+	for i, o := range r.events {
+		structure := newStructure(o)
+		data, err := s.serializer.Marshal(structure.Name, o)
+		if err != nil {
+			log.Error("cqrs.save.event", err)
+			return err
+		}
+
+		aggregate.Version++
+		events = append(events, Event{
+			ID:       generateID(),
+			Type:     structure.Name,
+			Schema:   schemaOf(o),
+			Codec:    s.serializer.codec.Name(),
+			Data:     data,
+			Created:  time.Now(),
+			Version:  aggregate.Version,
+			Metadata: metadata.copy(),
+		})
+
+		log.Debug("cqrs.save.aggregate.event", events[i].String())
+	}
+
+	// store aggregate state
+	if err := s.opts.Storage.Save(ctx, aggregate, events); err != nil {
+		log.Error("cqrs.save.aggregate", err)
+		return err
+	}
+
+	// send events to listeners of aggregate
+	if s.opts.Handlers != nil {
+		for _, eh := range s.opts.Handlers {
+			eh(ctx, aggregate, events, r.events)
+		}
+	}
+
+	s.mu.Lock()
+	for _, sub := range s.subscriptions {
+		sub.notify()
+	}
+	s.mu.Unlock()
+
+	r.init(aggregate.ID, aggregate.Version)
+	r.events = []interface{}{}
+	if len(events) > 0 {
+		r.Position = events[len(events)-1].Position
+	}
+
+	return nil
+}
+
+func (s *Repository) Load(id string) (Aggregate, error) {
+	return s.LoadContext(context.Background(), id)
+}
+
+// LoadContext rebuilds aggregate from its events, it stops as soon as ctx
+// is done and returns ctx.Err().
+func (s *Repository) LoadContext(ctx context.Context, id string) (Aggregate, error) {
+	var aggregate Aggregate
+
+	// check if aggregate is stored.
+	a, err := s.opts.Storage.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// take state from last snapshot, only events which appeared after
+	// snapshot version are replayed.
+	if s.snapshotter != nil {
+		aggregate, err = s.snapshotter.Load(ctx, a.ID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		aggregate = s.aggregateInstance(a.ID, 0)
+	}
+
+	log.Info("cqrs.load.aggregate", "%s", aggregate.Root().String())
+
+	if err := s.replay(ctx, aggregate, nil); err != nil {
+		return nil, err
+	}
+
+	return aggregate, nil
+}
+
+// LoadAtContext rebuilds read only aggregate from events up to (inclusive)
+// given version.
+func (s *Repository) LoadAtContext(ctx context.Context, id string, version uint64) (Aggregate, error) {
+	a, err := s.opts.Storage.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > a.Version {
+		return nil, fmt.Errorf("%s has no version %d yet", a.String(), version)
+	}
+
+	return s.history(ctx, a.ID, func(e Event) bool {
+		return e.Version <= version
+	})
+}
+
+// LoadAsOfContext rebuilds read only aggregate from events created until
+// (inclusive) given time.
+func (s *Repository) LoadAsOfContext(ctx context.Context, id string, at time.Time) (Aggregate, error) {
+	a, err := s.opts.Storage.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.history(ctx, a.ID, func(e Event) bool {
+		return !e.Created.After(at)
+	})
+}
+
+func (s *Repository) history(ctx context.Context, id string, until func(Event) bool) (Aggregate, error) {
+	aggregate := s.aggregateInstance(id, 0)
+	aggregate.Root().readOnly = true
+
+	if err := s.replay(ctx, aggregate, until); err != nil {
+		return nil, err
+	}
+
+	log.Info("cqrs.load.history", "%s", aggregate.Root().String())
+
+	return aggregate, nil
+}
+
+// replay applies stored events which appeared after aggregate version,
+// it stops on first event for which until returns false.
+func (s *Repository) replay(ctx context.Context, aggregate Aggregate, until func(Event) bool) error {
+	r := aggregate.Root()
+
+	// load aggregate events from given version.
+	events, err := s.opts.Storage.Events(ctx, r.Version, r.ID)
+	if err != nil {
+		return err
+	}
+	var event Event
+	for _, event = range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if until != nil && !until(event) {
+			break
+		}
+
+		e, err := s.Decode(event)
+		if err != nil {
+			log.Error("cqrs.load.event", err)
+			return err
+		}
+
+		if err := r.handler(e); err != nil {
+			log.Error("cqrs.handle.event", err)
+			return err
+		}
+		r.Version = event.Version
+		log.Debug("cqrs.load.aggregate.event", "%s", event.String())
+	}
+
+	return nil
+}
+
+// Decode deserializes stored event into its current structure, data stored
+// in older schema version is upcasted first.
+func (s *Repository) Decode(e Event) (interface{}, error) {
+	e.Type = s.serializer.name(e.Type)
+	t, ok := s.serializer.object[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("object %s is not registerd", e.Type)
+	}
+
+	data, err := s.upcast(e, schemaOf(t.Instance()))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.serializer.Unmarshal(e.Type, e.Codec, data)
+}
+
+func (s *Repository) aggregateInstance(id string, version uint64) Aggregate {
+	a, h := s.factory()
+	r := newRoot(h, s.name)
+	r.init(id, version)
+	a.Set(r)
+
+	return a
+}
+
+// Snapshotter makes snapshots of aggregates which got at least everyVersion
+// new events, checking them every frequency until ctx is done. Returned
+// Snapshotter might be Run manually as well.
+// todo return error
+func (s *Repository) Snapshotter(ctx context.Context, everyVersion uint, frequency time.Duration) *Snapshotter {
+	if s.snapshotter != nil {
+
+		return s.snapshotter
+	}
+
+	s.snapshotter = NewSnapshotter(s.name, everyVersion, s.opts.Storage, s)
+	s.snapshotter.done = make(chan struct{})
+	timer := time.NewTicker(frequency)
+
+	go func(t *time.Ticker) {
+		defer close(s.snapshotter.done)
+		defer t.Stop()
+
+		log.Info("cqrs.snapshot.start", "%s, every %s and %d version",
+			s.name, frequency, everyVersion)
+
+		for {
+			select {
+			case <-t.C:
+				s.snapshotter.Run()
+			case <-ctx.Done():
+				log.Info("cqrs.snapshot.stop", s.name)
+				return
+			}
+		}
+	}(timer)
+
+	return s.snapshotter
+}
+
+func NewRepository(f Factory, es []interface{}, os ...Option) *Repository {
+	aggregate, _ := f()
+	opts := newOptions(os...)
+	serializer := newSerializer(es...)
+	for legacy, name := range opts.Aliases {
+		serializer.alias(legacy, name)
+	}
+	for n, c := range opts.Codecs {
+		serializer.codecs[n] = c
+	}
+	if opts.Codec != nil {
+		serializer.codec = opts.Codec
+	}
+
+	return &Repository{
+		serializer: serializer,
+		opts:       opts,
+		factory:    f,
+		name:       newStructure(aggregate).Name,
+	}
+}
@@ -0,0 +1,105 @@
+package cqrs
+
+import (
+	"fmt"
+	//"github.com/alecthomas/binary"
+)
+
+type serializer struct {
+	object  map[string]structure
+	aliases map[string]string
+	codec   Codec
+	codecs  map[string]Codec
+}
+
+// name resolves legacy name of object to the registered one.
+func (s *serializer) name(n string) string {
+	if a, ok := s.aliases[n]; ok {
+		return a
+	}
+
+	return n
+}
+
+func (s *serializer) alias(legacy, name string) {
+	if _, ok := s.object[name]; !ok {
+		panic(fmt.Sprintf("cqrs: alias %s of not registered %s", legacy, name))
+	}
+
+	if o, ok := s.object[legacy]; ok {
+		panic(fmt.Sprintf("cqrs: alias %s is already a name of %s", legacy, o.Type))
+	}
+
+	s.aliases[legacy] = name
+}
+
+func (s *serializer) Marshal(n string, v interface{}) ([]byte, error) {
+	if _, ok := s.object[n]; !ok {
+		return []byte{}, fmt.Errorf("object '%s' is not registerd", n)
+	}
+
+	//data, err := gocsv.MarshalBytes(v)
+	//data, err := binary.Marshal(v)
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return data, nil
+}
+
+// Unmarshal decodes data written by codec, empty codec means JSON.
+func (s *serializer) Unmarshal(n, codec string, data []byte) (interface{}, error) {
+	t, ok := s.object[s.name(n)]
+	if !ok {
+		return nil, fmt.Errorf("object %s is not registerd", n)
+	}
+
+	c, err := s.codecOf(n, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	v := t.Instance()
+
+	//if err := gocsv.UnmarshalBytes(data, v); err != nil {
+	//if err := binary.Unmarshal(data, v); err != nil {
+	if err := c.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// codecOf returns Codec registered under name, empty name means JSON.
+func (s *serializer) codecOf(n, name string) (Codec, error) {
+	if name == "" {
+		return JSON, nil
+	}
+
+	c, ok := s.codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%s codec of %s is not registered", name, n)
+	}
+
+	return c, nil
+}
+
+func newSerializer(es ...interface{}) *serializer {
+	os := map[string]structure{}
+	for _, v := range es {
+		s := newStructure(v)
+		if o, ok := os[s.Name]; ok && o.Type != s.Type {
+			panic(fmt.Sprintf("cqrs: %s and %s are both registered as %s",
+				o.Type, s.Type, s.Name))
+		}
+		os[s.Name] = s
+	}
+
+	return &serializer{
+		object:  os,
+		aliases: map[string]string{},
+		codec:   JSON,
+		codecs:  map[string]Codec{JSON.Name(): JSON},
+	}
+}
@@ -0,0 +1,100 @@
+package cqrs
+
+import (
+	"context"
+
+	"github.com/sokool/gokit/log"
+)
+
+type Snapshotter struct {
+	frequency  uint
+	kind       string
+	store      Store
+	repo       *Repository
+	serializer *serializer
+	snapStruct structure
+	done       chan struct{}
+}
+
+// Done is closed when Snapshotter started by Repository.Snapshotter has
+// stopped, so store is not used by it anymore.
+func (s *Snapshotter) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Snapshotter) Run() {
+	ctx := context.Background()
+	as, err := s.store.Last(ctx, s.kind, s.frequency)
+	if err != nil {
+		log.Error("cqrs.snapshot.last", err)
+		return
+	}
+
+	for _, a := range as {
+		aggregate, err := s.repo.LoadContext(ctx, a.ID)
+		if err != nil {
+			log.Error("cqrs.snapshot.aggregate.load", err)
+			continue
+		}
+		//log.Info("cqrs.snap.test", aggregate.Root().String())
+		snap, err := s.serializer.Marshal(s.snapStruct.Name, aggregate.TakeSnapshot())
+		if err != nil {
+			log.Error("cqrs.snapshot.marshal", err)
+			continue
+		}
+
+		if err = s.store.Make(ctx, Snapshot{
+			AggregateID: aggregate.Root().ID,
+			Version:     aggregate.Root().Version,
+			Data:        snap}); err != nil {
+
+			log.Error("cqrs.snapshot.save", err)
+			continue
+		}
+
+		log.Info("cqrs.snapshot.success", aggregate.Root().String())
+	}
+}
+
+func (s *Snapshotter) Load(ctx context.Context, id string) (Aggregate, error) {
+
+	version, data := s.repo.opts.Storage.Snapshot(ctx, id)
+	aggregate := s.repo.aggregateInstance(id, version)
+
+	log.Info("cqrs.snapshot.load", "#%s v.%d", id[24:], version)
+	if len(data) == 0 {
+		return aggregate, nil
+	}
+
+	// snapshot is only a cache of events, when it can not be restored
+	// (ie. its structure has changed) aggregate is rebuilt from scratch.
+	snapshot, err := s.serializer.Unmarshal(s.snapStruct.Name, s.serializer.codec.Name(), data)
+	if err == nil {
+		err = aggregate.RestoreSnapshot(snapshot)
+	}
+
+	if err != nil {
+		log.Error("cqrs.snapshot.restore", err)
+		return s.repo.aggregateInstance(id, 0), nil
+	}
+
+	return aggregate, nil
+}
+
+func NewSnapshotter(kind string, frequency uint, s Store, r *Repository) *Snapshotter {
+	sStruct := r.Aggregate().TakeSnapshot()
+
+	// snapshots are written with repository codec, when it changes old
+	// snapshots can not be restored and aggregates are fully replayed.
+	serializer := newSerializer(sStruct)
+	serializer.codec, serializer.codecs = r.serializer.codec, r.serializer.codecs
+
+	return &Snapshotter{
+		frequency:  frequency,
+		store:      s,
+		repo:       r,
+		kind:       kind,
+		snapStruct: newStructure(sStruct),
+		serializer: serializer,
+	}
+}
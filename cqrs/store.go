@@ -0,0 +1,318 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"time"
+
+	"github.com/sokool/gokit/log"
+)
+
+type Store interface {
+	// Last is calculated by subtracting the last snapshot version
+	// from the current version with a where clause that only returned the
+	// aggregates with a difference greater than some number. This query
+	// will return all of the Aggregates that a snapshot to be created.
+	// The snapshotter would then iterate through this list of Aggregates
+	// to create the snapshots (if using	multiple snapshotters the
+	// competing consumer pattern works well here).
+	Last(ctx context.Context, kind string, vFrequency uint) ([]CQRSAggregate, error)
+
+	Make(ctx context.Context, s Snapshot) error
+	Snapshot(ctx context.Context, aggregate string) (uint64, []byte)
+
+	Load(ctx context.Context, id string) (CQRSAggregate, error)
+	Save(context.Context, CQRSAggregate, []Event) error
+
+	// load all aggregates and events from given version. Implementations
+	// should stop reading and return ctx.Err() once ctx is done.
+	Events(ctx context.Context, version uint64, aggregate string) ([]Event, error)
+
+	// ReadAll reads global log ($all stream) of every aggregate in commit
+	// order, starting after given position. At most limit events are
+	// returned, 0 means no limit. Save assigns monotonically increasing
+	// Position to each saved event, starting from 1.
+	ReadAll(ctx context.Context, position uint64, limit int, f Filter) ([]Record, error)
+}
+
+// Record is event read from global log, with aggregate it belongs to.
+type Record struct {
+	Event
+	Aggregate CQRSAggregate
+}
+
+// Filter of ReadAll, empty list matches every type.
+type Filter struct {
+	Events     []string // types of events
+	Aggregates []string // types of aggregates
+}
+
+// Match tells if event of given type, which belongs to aggregate of given
+// type, passes filter.
+func (f Filter) Match(event, aggregate string) bool {
+	return contains(f.Events, event) && contains(f.Aggregates, aggregate)
+}
+
+func contains(ss []string, s string) bool {
+	if len(ss) == 0 {
+		return true
+	}
+
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+type event struct {
+	id        string
+	aggregate string
+	data      []byte
+	kind      string
+	schema    uint
+	codec     string
+	version   uint64
+	created   time.Time
+	metadata  Metadata
+	position  uint64
+}
+
+type mem struct {
+	mu         sync.RWMutex
+	aggregates map[string]CQRSAggregate
+	events     map[string][]event
+	snapshots  map[string]Snapshot
+	all        []event
+
+	// test helper data
+	LastLoadID      string
+	LastLoadVersion uint64
+}
+
+func (m *mem) Make(ctx context.Context, s Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.snapshots[s.AggregateID] = s
+	return nil
+}
+
+func (m *mem) Last(ctx context.Context, kind string, frequency uint) ([]CQRSAggregate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var o []CQRSAggregate
+	for _, a := range m.aggregates {
+		var sv uint64
+		if a.Type != kind {
+			continue
+		}
+		//log.Debug("cqrs.store.last", "%s", a.String())
+		s, ok := m.snapshots[a.ID]
+		if ok {
+			sv = s.Version
+		}
+
+		is := a.Version - sv
+
+		if uint(is) < frequency {
+			log.Debug("cqrs.store.last",
+				"every %d, waiting for %d more events",
+				frequency, frequency-uint(is))
+			continue
+		}
+
+		o = append(o, CQRSAggregate{
+			ID:      a.ID,
+			Version: sv,
+			Type:    a.Type,
+		})
+	}
+
+	return o, nil
+}
+
+func (m *mem) Load(ctx context.Context, id string) (CQRSAggregate, error) {
+	if err := ctx.Err(); err != nil {
+		return CQRSAggregate{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.aggregates[id]
+	if !ok {
+		return CQRSAggregate{}, fmt.Errorf("aggregate %s not found", id)
+	}
+
+	return a, nil
+}
+
+func (m *mem) Snapshot(ctx context.Context, aggregateID string) (uint64, []byte) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if s, ok := m.snapshots[aggregateID]; ok {
+		return s.Version, s.Data
+	}
+
+	return 0, []byte{}
+}
+
+func (m *mem) Save(ctx context.Context, a CQRSAggregate, es []Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// check if aggregate has not been changed by other request!
+	if l, ok := m.aggregates[a.ID]; ok {
+		if (a.Version - uint64(len(es))) != l.Version {
+			return fmt.Errorf(
+				"%s version missmatch, arrived: %d, expects: %d",
+				a.Type, a.Version, l.Version)
+		}
+	}
+
+	m.aggregates[a.ID] = a
+	for i, e := range es {
+		es[i].Position = uint64(len(m.all)) + 1
+		n := event{
+			id:        e.ID,
+			aggregate: a.ID,
+			version:   e.Version,
+			data:      e.Data,
+			kind:      e.Type,
+			schema:    e.Schema,
+			codec:     e.Codec,
+			created:   e.Created,
+			metadata:  e.Metadata,
+			position:  es[i].Position,
+		}
+		m.events[a.ID] = append(m.events[a.ID], n)
+		m.all = append(m.all, n)
+	}
+
+	return nil
+}
+
+func (m *mem) Events(ctx context.Context, fromVersion uint64, id string) ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.LastLoadID = id
+	m.LastLoadVersion = fromVersion
+
+	//log.Debug("cqrs.store.events",
+	//	"aggregate:%s from %d version", id, fromVersion)
+
+	var events []Event
+
+	//if fromVersion > 0 {
+	//	for i := int(fromVersion); i <= len(m.events[id]); i++ {
+	//		log.Debug("cqrs.store.events.iterator", "version:%d, %d",
+	//			i, m.events[id][i-1].version)
+	//	}
+	//}
+
+	for _, e := range m.events[id] {
+		//log.Debug("cqrs.store.events.loading", "%+v", e)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if e.version <= fromVersion {
+			continue
+		}
+
+		events = append(events, e.event())
+	}
+
+	return events, nil
+}
+
+func (m *mem) ReadAll(ctx context.Context, position uint64, limit int, f Filter) ([]Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var rs []Record
+	for i := position; i < uint64(len(m.all)); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if limit > 0 && len(rs) == limit {
+			break
+		}
+
+		e := m.all[i]
+		a := m.aggregates[e.aggregate]
+		if !f.Match(e.kind, a.Type) {
+			continue
+		}
+
+		rs = append(rs, Record{
+			Event:     e.event(),
+			Aggregate: CQRSAggregate{ID: a.ID, Type: a.Type, Version: e.version},
+		})
+	}
+
+	return rs, nil
+}
+
+func (e event) event() Event {
+	return Event{
+		ID:       e.id,
+		Type:     e.kind,
+		Schema:   e.schema,
+		Codec:    e.codec,
+		Data:     e.data,
+		Version:  e.version,
+		Created:  e.created,
+		Metadata: e.metadata.copy(),
+		Position: e.position,
+	}
+}
+
+// Test Helper functions
+func (m *mem) AggregatesCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.aggregates)
+}
+
+func (m *mem) AggregatesEventsCount(id string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	es, ok := m.events[id]
+	if !ok {
+		return 0
+	}
+
+	return len(es)
+}
+
+func NewMemoryStorage() *mem {
+	return &mem{
+		aggregates: map[string]CQRSAggregate{},
+		events:     map[string][]event{},
+		snapshots:  map[string]Snapshot{},
+	}
+}
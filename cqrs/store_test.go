@@ -0,0 +1,14 @@
+package cqrs_test
+
+import (
+	"testing"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/cqrs/storetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (cqrs.Store, func()) {
+		return cqrs.NewMemoryStorage(), func() {}
+	})
+}
@@ -0,0 +1,307 @@
+// Package storetest checks if implementation of cqrs.Store behaves as
+// repository expects it to. Every store runs it in its tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) (cqrs.Store, func()) {
+//			s := open(t)
+//			return s, func() { s.Close() }
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/gokit/test/is"
+)
+
+// ID of aggregate used by tests, IDs of its events are derived from it.
+const ID = "7f1c2b7e-55aa-4c3e-9b1d-2f6a9d3c8e01"
+
+// Other is ID of second aggregate used by tests.
+const Other = "0a1b2c3d-55aa-4c3e-9b1d-2f6a9d3c8e02"
+
+var ctx = context.Background()
+
+// Events returns events of aggregate id in versions from..to, Tom is actor
+// of them.
+func Events(id string, from, to uint64) []cqrs.Event {
+	var es []cqrs.Event
+	for v := from; v <= to; v++ {
+		es = append(es, cqrs.Event{
+			ID:       fmt.Sprintf("%s%012d", id[:24], v),
+			Type:     "restaurant.meal_selected",
+			Schema:   1,
+			Codec:    cqrs.JSON.Name(),
+			Data:     []byte(fmt.Sprintf(`{"Person":"Tom","Meal":"%d"}`, v)),
+			Version:  v,
+			Created:  time.Now().Round(0),
+			Metadata: cqrs.Metadata{cqrs.Actor: "tom"},
+		})
+	}
+
+	return es
+}
+
+// Save stores Events of aggregate id of given kind into s.
+func Save(s cqrs.Store, id, kind string, from, to uint64) error {
+	return s.Save(ctx, cqrs.CQRSAggregate{ID: id, Type: kind, Version: to},
+		Events(id, from, to))
+}
+
+// Run tests store returned by open, every test gets new empty store and
+// calls returned function when it is done with it.
+func Run(t *testing.T, open func(*testing.T) (cqrs.Store, func())) {
+	for _, c := range []struct {
+		name string
+		test func(*testing.T, cqrs.Store)
+	}{
+		{"SaveAndEvents", saveAndEvents},
+		{"VersionConflict", versionConflict},
+		{"LastAndSnapshots", lastAndSnapshots},
+		{"ReadAll", readAll},
+		{"ConcurrentSaves", concurrentSaves},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, done := open(t)
+			defer done()
+
+			c.test(t, s)
+		})
+	}
+}
+
+func saveAndEvents(t *testing.T, s cqrs.Store) {
+	//WHEN I save 10 events in two commits
+	expected := Events(ID, 1, 10)
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: ID, Type: "restaurant", Version: 4}, expected[:4]))
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: ID, Type: "restaurant", Version: 10}, expected[4:]))
+
+	//I EXPECT all of them in order, as they were saved
+	es, err := s.Events(ctx, 0, ID)
+	is.NotErr(t, err)
+	is.Equal(t, len(expected), len(es))
+	for i, e := range es {
+		equal(t, expected[i], e)
+	}
+
+	//AND I EXPECT only newer ones when reading from version 8
+	es, err = s.Events(ctx, 8, ID)
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(es))
+	is.Equal(t, uint64(9), es[0].Version)
+
+	//AND I EXPECT aggregate in last version
+	a, err := s.Load(ctx, ID)
+	is.NotErr(t, err)
+	is.Equal(t, ID, a.ID)
+	is.Equal(t, uint64(10), a.Version)
+	is.Equal(t, "restaurant", a.Type)
+
+	//AND I EXPECT unknown aggregate not found and without events
+	_, err = s.Load(ctx, Other)
+	is.Err(t, err, "not found")
+	es, err = s.Events(ctx, 0, Other)
+	is.NotErr(t, err)
+	is.Equal(t, 0, len(es))
+}
+
+func versionConflict(t *testing.T, s cqrs.Store) {
+	//WHEN I have aggregate in version 10
+	is.NotErr(t, Save(s, ID, "restaurant", 1, 10))
+
+	//THEN I save events of stale aggregate, which knows only version 8
+	err := Save(s, ID, "restaurant", 9, 11)
+
+	//I EXPECT version missmatch and none of them stored
+	is.True(t, err != nil && strings.Contains(err.Error(), "version missmatch"),
+		"version missmatch expected, got %v", err)
+
+	es, err := s.Events(ctx, 0, ID)
+	is.NotErr(t, err)
+	is.Equal(t, 10, len(es))
+	a, err := s.Load(ctx, ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(10), a.Version)
+
+	//AND I EXPECT aggregate saved by one who knows its last version
+	is.NotErr(t, Save(s, ID, "restaurant", 11, 11))
+}
+
+func lastAndSnapshots(t *testing.T, s cqrs.Store) {
+	//WHEN I have restaurant with 5 events and an aggregate of other type
+	is.NotErr(t, Save(s, ID, "restaurant", 1, 5))
+	is.NotErr(t, Save(s, Other, "person", 1, 7))
+
+	//I EXPECT only restaurant waiting for snapshot
+	as, err := s.Last(ctx, "restaurant", 5)
+	is.NotErr(t, err)
+	is.Equal(t, 1, len(as))
+	is.Equal(t, ID, as[0].ID)
+	is.Equal(t, "restaurant", as[0].Type)
+
+	//AND I EXPECT no snapshot yet
+	v, data := s.Snapshot(ctx, ID)
+	is.Equal(t, uint64(0), v)
+	is.Equal(t, 0, len(data))
+
+	//THEN I make snapshot in version 5
+	is.NotErr(t, s.Make(ctx, cqrs.Snapshot{AggregateID: ID, Version: 5, Data: []byte("state")}))
+
+	//I EXPECT it loaded and no restaurant waiting for next one
+	v, data = s.Snapshot(ctx, ID)
+	is.Equal(t, uint64(5), v)
+	is.Equal(t, "state", string(data))
+
+	as, err = s.Last(ctx, "restaurant", 5)
+	is.NotErr(t, err)
+	is.Equal(t, 0, len(as))
+}
+
+func readAll(t *testing.T, s cqrs.Store) {
+	//WHEN I save events of restaurant and person in turns
+	is.NotErr(t, Save(s, ID, "restaurant", 1, 2))
+	joined := cqrs.Event{ID: Other, Type: "person.joined", Data: []byte(`{}`),
+		Version: 1, Created: time.Now().Round(0)}
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: Other, Type: "person", Version: 1},
+		[]cqrs.Event{joined}))
+	scheduled := Events(ID, 3, 3)
+	scheduled[0].Type = "restaurant.scheduled"
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: ID, Type: "restaurant", Version: 3}, scheduled))
+
+	//I EXPECT positions assigned in commit order
+	is.Equal(t, uint64(4), scheduled[0].Position)
+
+	rs, err := s.ReadAll(ctx, 0, 0, cqrs.Filter{})
+	is.NotErr(t, err)
+	is.Equal(t, 4, len(rs))
+	for i, r := range rs {
+		is.Equal(t, uint64(i+1), r.Position)
+	}
+	equal(t, joined, rs[2].Event)
+	is.Equal(t, cqrs.CQRSAggregate{ID: Other, Type: "person", Version: 1}, rs[2].Aggregate)
+	equal(t, scheduled[0], rs[3].Event)
+	is.Equal(t, cqrs.CQRSAggregate{ID: ID, Type: "restaurant", Version: 3}, rs[3].Aggregate)
+
+	//AND I EXPECT positions in events of aggregate
+	es, err := s.Events(ctx, 0, ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(1), es[0].Position)
+	is.Equal(t, uint64(4), es[2].Position)
+
+	//AND I EXPECT log read from position, with limit
+	rs, err = s.ReadAll(ctx, 1, 2, cqrs.Filter{})
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(rs))
+	is.Equal(t, uint64(2), rs[0].Position)
+	is.Equal(t, uint64(3), rs[1].Position)
+
+	rs, err = s.ReadAll(ctx, 4, 0, cqrs.Filter{})
+	is.NotErr(t, err)
+	is.Equal(t, 0, len(rs))
+
+	//AND I EXPECT log filtered by types of aggregates and events
+	for _, c := range []struct {
+		filter    cqrs.Filter
+		positions []uint64
+	}{
+		{cqrs.Filter{Aggregates: []string{"restaurant"}}, []uint64{1, 2, 4}},
+		{cqrs.Filter{Aggregates: []string{"restaurant", "person"}}, []uint64{1, 2, 3, 4}},
+		{cqrs.Filter{Events: []string{"person.joined"}}, []uint64{3}},
+		{cqrs.Filter{Events: []string{"person.joined", "restaurant.scheduled"}}, []uint64{3, 4}},
+		{cqrs.Filter{Aggregates: []string{"restaurant"}, Events: []string{"restaurant.scheduled"}}, []uint64{4}},
+		{cqrs.Filter{Aggregates: []string{"person"}, Events: []string{"restaurant.scheduled"}}, nil},
+		{cqrs.Filter{Aggregates: []string{"tavern"}}, nil},
+	} {
+		rs, err := s.ReadAll(ctx, 0, 0, c.filter)
+		is.NotErr(t, err)
+
+		var ps []uint64
+		for _, r := range rs {
+			ps = append(ps, r.Position)
+		}
+		is.Equal(t, c.positions, ps)
+	}
+
+	//AND I EXPECT limit counted among filtered events
+	rs, err = s.ReadAll(ctx, 0, 1, cqrs.Filter{Events: []string{"restaurant.scheduled"}})
+	is.NotErr(t, err)
+	is.Equal(t, 1, len(rs))
+	is.Equal(t, uint64(4), rs[0].Position)
+}
+
+func concurrentSaves(t *testing.T, s cqrs.Store) {
+	//WHEN 8 writers save 5 commits of their own aggregates at once, and
+	//all of them save same version of shared aggregate
+	is.NotErr(t, Save(s, Other, "person", 1, 1))
+
+	var wg sync.WaitGroup
+	errs, conflicts := make(chan error, 8*5), make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for v := uint64(1); v <= 5; v++ {
+				errs <- Save(s, id, "restaurant", v, v)
+			}
+			conflicts <- Save(s, Other, "person", 2, 2)
+		}(fmt.Sprintf("%02d%s", w, ID[2:]))
+	}
+	wg.Wait()
+	close(errs)
+	close(conflicts)
+
+	//I EXPECT every commit of own aggregate saved
+	for err := range errs {
+		is.NotErr(t, err)
+	}
+
+	//AND I EXPECT only one of shared aggregate saves accepted, others
+	//rejected as version missmatch
+	var saved int
+	for err := range conflicts {
+		if err == nil {
+			saved++
+			continue
+		}
+		is.True(t, strings.Contains(err.Error(), "version missmatch"),
+			"version missmatch expected, got %v", err)
+	}
+	is.Equal(t, 1, saved)
+
+	//AND I EXPECT every event in global log once, at following positions
+	rs, err := s.ReadAll(ctx, 0, 0, cqrs.Filter{})
+	is.NotErr(t, err)
+	is.Equal(t, 1+8*5+1, len(rs))
+	for i, r := range rs {
+		is.Equal(t, uint64(i+1), r.Position)
+	}
+
+	for w := 0; w < 8; w++ {
+		es, err := s.Events(ctx, 0, fmt.Sprintf("%02d%s", w, ID[2:]))
+		is.NotErr(t, err)
+		is.Equal(t, 5, len(es))
+	}
+}
+
+// equal compares stored event, which might have time in other location and
+// empty metadata instead of nil, with saved one.
+func equal(t *testing.T, exp, got cqrs.Event) {
+	is.Equal(t, exp.ID, got.ID)
+	is.Equal(t, exp.Type, got.Type)
+	is.Equal(t, exp.Schema, got.Schema)
+	is.Equal(t, exp.Codec, got.Codec)
+	is.Equal(t, string(exp.Data), string(got.Data))
+	is.Equal(t, exp.Version, got.Version)
+	if len(exp.Metadata) > 0 || len(got.Metadata) > 0 {
+		is.Equal(t, exp.Metadata, got.Metadata)
+	}
+	is.True(t, exp.Created.Equal(got.Created), "%s created at %s, got %s",
+		exp.ID, exp.Created, got.Created)
+}
@@ -0,0 +1,218 @@
+package cqrs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sokool/gokit/log"
+)
+
+// Checkpoints keep positions in global log up to which subscriptions have
+// handled events.
+type Checkpoints interface {
+	Checkpoint(ctx context.Context, subscription string) (uint64, error)
+	Commit(ctx context.Context, subscription string, position uint64) error
+}
+
+// Subscription feeds handler with events of repository aggregates read
+// from global log. Run replays log from stored checkpoint and then keeps
+// following it, past and live events are read from same log, so there are
+// no gaps or duplicates when subscription switches to live ones.
+//
+// Checkpoint is committed after every batch, so events handled after last
+// commit are delivered again when subscription is restarted (at least
+// once delivery), see Idempotent.
+type Subscription struct {
+	name        string
+	repository  *Repository
+	handler     ContextHandlerFunc
+	checkpoints Checkpoints
+	batch       int
+	poll        time.Duration
+	wake        chan struct{}
+
+	mu       sync.RWMutex
+	position uint64
+}
+
+type SubscriptionOption func(*Subscription)
+
+// BatchSize is number of events read from log at once, checkpoint is
+// committed after each batch. Default is 100.
+func BatchSize(n int) SubscriptionOption {
+	return func(s *Subscription) {
+		s.batch = n
+	}
+}
+
+// PollInterval of log, events saved by this process are delivered at once,
+// events saved by other processes might wait that long. Default is second.
+func PollInterval(d time.Duration) SubscriptionOption {
+	return func(s *Subscription) {
+		s.poll = d
+	}
+}
+
+// Subscribe h to events of repository aggregates under given name, name is
+// a key of checkpoint in c.
+func (r *Repository) Subscribe(name string, h ContextHandlerFunc, c Checkpoints, os ...SubscriptionOption) *Subscription {
+	s := &Subscription{
+		name:        name,
+		repository:  r,
+		handler:     h,
+		checkpoints: c,
+		batch:       100,
+		poll:        time.Second,
+		wake:        make(chan struct{}, 1),
+	}
+	for _, o := range os {
+		o(s)
+	}
+
+	r.mu.Lock()
+	r.subscriptions = append(r.subscriptions, s)
+	r.mu.Unlock()
+
+	return s
+}
+
+// Run handles events until ctx is done or error occurs.
+func (s *Subscription) Run(ctx context.Context) error {
+	p, err := s.checkpoints.Checkpoint(ctx, s.name)
+	if err != nil {
+		return err
+	}
+	s.setPosition(p)
+
+	log.Info("cqrs.subscription.run", "%s from %d position", s.name, p)
+	for {
+		n, err := s.next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.wake:
+		case <-time.After(s.poll):
+		}
+	}
+}
+
+// Position of last handled event.
+func (s *Subscription) Position() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.position
+}
+
+// next handles batch of events and commits checkpoint, it returns number
+// of handled events.
+func (s *Subscription) next(ctx context.Context) (int, error) {
+	p, n, err := s.repository.Replay(ctx, s.Position(), s.batch, s.handler)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	if err := s.checkpoints.Commit(ctx, s.name, p); err != nil {
+		return 0, err
+	}
+	s.setPosition(p)
+
+	return n, nil
+}
+
+// Replay reads at most limit events of repository aggregates from global
+// log after given position and passes them to h. It returns position of
+// last read event and number of events.
+func (r *Repository) Replay(ctx context.Context, position uint64, limit int, h ContextHandlerFunc) (uint64, int, error) {
+	f := Filter{Aggregates: []string{r.name}}
+	rs, err := r.opts.Storage.ReadAll(ctx, position, limit, f)
+	if err != nil || len(rs) == 0 {
+		return position, 0, err
+	}
+
+	// following events of same aggregate are handled together, as they
+	// are after Save.
+	for i := 0; i < len(rs); {
+		a := rs[i].Aggregate
+		var es []Event
+		var ds []interface{}
+		for ; i < len(rs) && rs[i].Aggregate.ID == a.ID; i++ {
+			d, err := r.Decode(rs[i].Event)
+			if err != nil {
+				return position, 0, err
+			}
+
+			es, ds = append(es, rs[i].Event), append(ds, d)
+		}
+
+		a.Version = es[len(es)-1].Version
+		h(ctx, a, es, ds)
+	}
+
+	return rs[len(rs)-1].Position, len(rs), nil
+}
+
+func (s *Subscription) setPosition(p uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.position = p
+}
+
+// notify subscription about saved events, it does not block.
+func (s *Subscription) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Idempotent wraps h, so events at or before position returned by last are
+// skipped. Projection which keeps position of last applied event together
+// with its state ignores events delivered again by Subscription.
+func Idempotent(h ContextHandlerFunc, last func() uint64) ContextHandlerFunc {
+	return func(ctx context.Context, a CQRSAggregate, es []Event, ds []interface{}) {
+		p := last()
+		for i, e := range es {
+			if e.Position > p {
+				h(ctx, a, es[i:], ds[i:])
+				return
+			}
+		}
+	}
+}
+
+type memCheckpoints struct {
+	mu        sync.Mutex
+	positions map[string]uint64
+}
+
+// NewMemoryCheckpoints keeps checkpoints in memory, it suits projections
+// which are kept in memory too and are rebuilt from scratch on start.
+func NewMemoryCheckpoints() Checkpoints {
+	return &memCheckpoints{positions: map[string]uint64{}}
+}
+
+func (m *memCheckpoints) Checkpoint(ctx context.Context, name string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.positions[name], nil
+}
+
+func (m *memCheckpoints) Commit(ctx context.Context, name string, position uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.positions[name] = position
+	return nil
+}
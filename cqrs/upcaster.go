@@ -0,0 +1,72 @@
+package cqrs
+
+import "fmt"
+
+// Versioned is implemented by events which structure has changed over time,
+// Schema returns current version of event structure. Events which are not
+// Versioned are in schema 1.
+type Versioned interface {
+	Schema() uint
+}
+
+// Upcaster transforms serialized event data from given schema version
+// to the next one. Data is encoded with Codec c event has been stored with
+// and upcasted data has to be encoded with it too.
+type Upcaster func(c Codec, data []byte) ([]byte, error)
+
+// Upcast registers fn which transforms kind of event data stored in schema
+// version from, to version from+1.
+func Upcast(kind string, from uint, fn Upcaster) Option {
+	return func(o *Options) {
+		if o.Upcasters == nil {
+			o.Upcasters = map[string]map[uint]Upcaster{}
+		}
+
+		if o.Upcasters[kind] == nil {
+			o.Upcasters[kind] = map[uint]Upcaster{}
+		}
+
+		o.Upcasters[kind][from] = fn
+	}
+}
+
+func schemaOf(v interface{}) uint {
+	if s, ok := v.(Versioned); ok {
+		return s.Schema()
+	}
+
+	return 1
+}
+
+// upcast runs all upcasters of event until data matches current schema.
+func (s *Repository) upcast(e Event, current uint) ([]byte, error) {
+	data, v := e.Data, e.Schema
+	if v == 0 {
+		v = 1
+	}
+
+	c, err := s.serializer.codecOf(e.Type, e.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; v < current; v++ {
+		fn, ok := s.opts.Upcasters[e.Type][v]
+		if !ok {
+			return nil, fmt.Errorf(
+				"%s can not be upcasted from v%d to v%d, upcaster not registered",
+				e.Type, v, current)
+		}
+
+		if data, err = fn(c, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if v > current {
+		return nil, fmt.Errorf("%s in v%d is newer than known v%d",
+			e.Type, v, current)
+	}
+
+	return data, nil
+}
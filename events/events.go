@@ -1,41 +1,111 @@
 package events
 
-import "time"
+import (
+	"time"
 
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+// Person fields are tagged as shred subjects, so they are encrypted with
+// person's key when stored and become forgotten, see shred.IsForgotten,
+// once it is destroyed.
+// Protobuf tags are field numbers of messages in events.proto.
 type (
 	Created struct {
-		Restaurant string
-		Info       string
-		Menu       []string
-		At         time.Time
+		Restaurant string    `protobuf:"1"`
+		Info       string    `protobuf:"2"`
+		Menu       []string  `protobuf:"3"`
+		At         time.Time `protobuf:"4"`
 	}
 
 	MealSelected struct {
-		Person string
-		Meal   string
-		At     time.Time
+		Person string    `shred:"subject" protobuf:"1"`
+		Meal   string    `protobuf:"2"`
+		At     time.Time `protobuf:"3"`
 	}
 
 	MealChanged struct {
-		Person       string
-		PreviousMeal string
-		NewMeal      string
-		At           time.Time
+		Person       string    `shred:"subject" protobuf:"1"`
+		PreviousMeal string    `protobuf:"2"`
+		NewMeal      string    `protobuf:"3"`
+		At           time.Time `protobuf:"4"`
 	}
 
 	Scheduled struct {
-		On time.Time
+		On time.Time `protobuf:"1"`
 	}
 
 	Rescheduled struct {
-		On time.Time
+		On time.Time `protobuf:"1"`
+	}
+
+	Canceled struct {
+		Reason string    `protobuf:"1"`
+		At     time.Time `protobuf:"2"`
 	}
 )
 
+// Names under which events are stored. They must never change, even when
+// Go type is renamed or moved, schema version is stored next to them.
+const (
+	CreatedName      = "restaurant.created"
+	ScheduledName    = "restaurant.scheduled"
+	RescheduledName  = "restaurant.rescheduled"
+	MealSelectedName = "restaurant.meal_selected"
+	MealChangedName  = "restaurant.meal_changed"
+	CanceledName     = "restaurant.canceled"
+)
+
+func (Created) EventName() string      { return CreatedName }
+func (Scheduled) EventName() string    { return ScheduledName }
+func (Rescheduled) EventName() string  { return RescheduledName }
+func (MealSelected) EventName() string { return MealSelectedName }
+func (MealChanged) EventName() string  { return MealChangedName }
+func (Canceled) EventName() string     { return CanceledName }
+
+// Aliases maps names under which events were stored before they got
+// explicit names (Go struct names) to the current ones.
+var Aliases = map[string]string{
+	"Created":      CreatedName,
+	"Scheduled":    ScheduledName,
+	"Rescheduled":  RescheduledName,
+	"MealSelected": MealSelectedName,
+	"MealChanged":  MealChangedName,
+}
+
 var All = []interface{}{
 	&Created{},
 	&Scheduled{},
 	&Rescheduled{},
 	&MealChanged{},
 	&MealSelected{},
+	&Canceled{},
+}
+
+// Schema of MealChanged is 2, in schema 1 NewMeal was named ActualMeal.
+func (MealChanged) Schema() uint { return 2 }
+
+// mealChangedV1 is MealChanged in schema 1. Person is not tagged as shred
+// subject, so it is upcasted as stored, encrypted or not.
+type mealChangedV1 struct {
+	Person       string    `protobuf:"1"`
+	PreviousMeal string    `protobuf:"2"`
+	ActualMeal   string    `protobuf:"3"`
+	At           time.Time `protobuf:"4"`
+}
+
+// UpcastMealChangedV1 renames ActualMeal of MealChanged stored in schema 1
+// to NewMeal, data is decoded and encoded with codec c it was stored with.
+func UpcastMealChangedV1(c cqrs.Codec, data []byte) ([]byte, error) {
+	var m mealChangedV1
+	if err := c.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return c.Marshal(&MealChanged{
+		Person:       m.Person,
+		PreviousMeal: m.PreviousMeal,
+		NewMeal:      m.ActualMeal,
+		At:           m.At,
+	})
 }
@@ -0,0 +1,50 @@
+package cqrsexample
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/gokit/test/is"
+)
+
+// impostor claims name of events.Created.
+type impostor struct{}
+
+func (impostor) EventName() string { return events.CreatedName }
+
+func TestEventsHaveExplicitNames(t *testing.T) {
+	names := map[string]bool{}
+	for _, e := range events.All {
+		n, ok := e.(cqrs.Named)
+		is.True(t, ok, "%T has no explicit name", e)
+		is.True(t, strings.HasPrefix(n.EventName(), "restaurant."),
+			"%s expects restaurant namespace", n.EventName())
+		is.True(t, !names[n.EventName()], "%s is not unique", n.EventName())
+		names[n.EventName()] = true
+	}
+
+	for legacy, name := range events.Aliases {
+		is.True(t, names[name], "alias %s of unknown %s", legacy, name)
+	}
+}
+
+func TestDuplicatedEventNameFailsFast(t *testing.T) {
+	defer func() {
+		r := recover()
+		is.True(t, r != nil, "expects panic")
+		is.True(t, strings.Contains(r.(string), events.CreatedName),
+			"unexpected panic %v", r)
+	}()
+
+	cqrs.NewRepository(factory, append(events.All, &impostor{}))
+}
+
+func TestAliasOfUnknownEventFailsFast(t *testing.T) {
+	defer func() {
+		is.True(t, recover() != nil, "expects panic")
+	}()
+
+	newRepository(cqrs.Alias("Closed", "restaurant.closed"))
+}
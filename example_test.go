@@ -1,11 +1,22 @@
 package cqrsexample_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"time"
 
 	"github.com/sokool/cqrsexample"
+	"github.com/sokool/cqrsexample/codec"
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/cqrsexample/query"
+	"github.com/sokool/cqrsexample/shred"
 	"github.com/sokool/gokit/test/is"
 	"github.com/tonnerre/golang-pretty"
 )
@@ -114,6 +125,1223 @@ func TestChooseMeal(t *testing.T) {
 
 }
 
+func TestContextCancellation(t *testing.T) {
+	//WHEN I create and save PasiBus restaurant
+	restaurant := service.Restaurant.New()
+	is.NotErr(t, restaurant.Create(
+		"PasiBus",
+		"dobre burgery",
+		"BBQ", "Eggy", "Gonzo"))
+	is.NotErr(t, service.Restaurant.Save(restaurant))
+
+	//THEN I load it with already canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := service.Restaurant.LoadContext(ctx, restaurant.Root().ID)
+
+	//I EXPECT context canceled error
+	is.Equal(t, context.Canceled, err)
+
+	//THEN I schedule it and save with canceled context
+	is.NotErr(t, restaurant.Schedule(time.Now().Add(24*time.Hour)))
+	err = service.Restaurant.SaveContext(ctx, restaurant)
+
+	//I EXPECT context canceled error and restaurant still in version 1
+	is.Equal(t, context.Canceled, err)
+	loaded, err := service.Restaurant.LoadContext(context.Background(), restaurant.Root().ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(1), loaded.Root().Version)
+
+	//THEN I load it with expired deadline
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = service.Restaurant.LoadContext(ctx, restaurant.Root().ID)
+
+	//I EXPECT deadline exceeded error
+	is.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestHistoricalLoad(t *testing.T) {
+	//WHEN I create PasiBus restaurant where Tom chooses Eggy
+	restaurant := service.Restaurant.New()
+	is.NotErr(t, restaurant.Create(
+		"PasiBus",
+		"dobre burgery",
+		"BBQ", "Eggy", "Gonzo"))
+	is.NotErr(t, restaurant.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, restaurant.ChooseMeal("Tom", "Eggy"))
+	is.NotErr(t, service.Restaurant.Save(restaurant))
+	yesterday := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	//THEN Tom changes mind to Gonzo
+	is.NotErr(t, restaurant.ChooseMeal("Tom", "Gonzo"))
+	is.NotErr(t, service.Restaurant.Save(restaurant))
+	id := restaurant.Root().ID
+
+	//I EXPECT Eggy for Tom in version 3 and before changing mind
+	past, err := service.Restaurant.LoadAt(id, 3)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(3), past.Root().Version)
+	is.Equal(t, "Eggy", past.Meal("Tom"))
+
+	past, err = service.Restaurant.LoadAsOf(id, yesterday)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(3), past.Root().Version)
+	is.Equal(t, "Eggy", past.Meal("Tom"))
+
+	//AND I EXPECT nothing chosen in version 2 and Gonzo in current one
+	past, err = service.Restaurant.LoadAt(id, 2)
+	is.NotErr(t, err)
+	is.Equal(t, "", past.Meal("Tom"))
+
+	current, err := service.Restaurant.Load(id)
+	is.NotErr(t, err)
+	is.Equal(t, "Gonzo", current.Meal("Tom"))
+
+	//THEN I change restaurant loaded from the past and save it
+	is.True(t, past.Root().ReadOnly(), "read only restaurant expected")
+	is.NotErr(t, past.ChooseMeal("Greg", "BBQ"))
+
+	//I EXPECT read only error
+	is.Err(t, service.Restaurant.Save(past), "read only")
+
+	//THEN I load restaurant in version which does not exist yet
+	_, err = service.Restaurant.LoadAt(id, 5)
+
+	//I EXPECT no version error
+	is.Err(t, err, "no version")
+}
+
+func TestEventMetadata(t *testing.T) {
+	//WHEN Tom creates and schedules Zupa.pl restaurant from lunch app
+	ctx := cqrs.WithMetadata(context.Background(), cqrs.Actor, "tom@zupa.pl")
+	ctx = cqrs.WithMetadata(ctx, cqrs.CorrelationID, "request#1")
+	ctx = cqrs.WithMetadata(ctx, cqrs.Source, "lunch-app")
+
+	restaurant := service.Restaurant.New()
+	is.NotErr(t, restaurant.Create("Zupa.pl", "miliardy zup", "Ogórkowa"))
+	is.NotErr(t, restaurant.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, service.Restaurant.SaveContext(ctx, restaurant))
+
+	audit := func(key, value string) []query.Record {
+		p, err := service.Query.Audit(key, value, query.List{})
+		is.NotErr(t, err)
+		return p.Records
+	}
+
+	//I EXPECT both events in Tom's audit trail with metadata
+	rs := audit(cqrs.Actor, "tom@zupa.pl")
+	is.Equal(t, 2, len(rs))
+	is.Equal(t, events.CreatedName, rs[0].Event)
+	is.Equal(t, events.ScheduledName, rs[1].Event)
+	is.Equal(t, restaurant.Root().ID, rs[1].TavernUUID)
+	is.Equal(t, "request#1", rs[1].Metadata[cqrs.CorrelationID])
+	is.Equal(t, "lunch-app", rs[1].Metadata[cqrs.Source])
+
+	//THEN Greg chooses meal as a reaction on Scheduled event
+	cause := cqrs.Event{ID: "event#2", Metadata: rs[1].Metadata}
+	ctx = cqrs.WithMetadata(cqrs.CausedBy(context.Background(), cause), cqrs.Actor, "greg@zupa.pl")
+	is.NotErr(t, restaurant.ChooseMeal("Greg", "Ogórkowa"))
+	is.NotErr(t, service.Restaurant.SaveContext(ctx, restaurant))
+
+	//I EXPECT Greg's event caused by Scheduled event within same correlation
+	rs = audit(cqrs.CausationID, "event#2")
+	is.Equal(t, 1, len(rs))
+	is.Equal(t, events.MealSelectedName, rs[0].Event)
+	is.Equal(t, "greg@zupa.pl", rs[0].Metadata[cqrs.Actor])
+	is.Equal(t, 3, len(audit(cqrs.CorrelationID, "request#1")))
+}
+
+func TestMixedCodecsStream(t *testing.T) {
+	//WHEN I create restaurant with service writing events in JSON
+	store := cqrs.NewMemoryStorage()
+	people := cqrsexample.People(shred.NewMemoryKeys())
+	restaurant := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(store)), people).Restaurant.New()
+	is.NotErr(t, restaurant.Create("PasiBus", "dobre burgery", "BBQ", "Eggy"))
+	is.NotErr(t, cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(store)), people).Restaurant.Save(restaurant))
+	id := restaurant.Root().ID
+
+	//THEN I append events with MessagePack, protobuf and gob services
+	for i, c := range []cqrs.Codec{codec.MessagePack, codec.Protobuf, codec.Gob} {
+		s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(store), cqrs.Codecs(c, codec.All...)), people)
+		r, err := s.Restaurant.Load(id)
+		is.NotErr(t, err)
+		if i == 0 {
+			is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+		}
+		is.NotErr(t, r.ChooseMeal("Tom", c.Name()))
+		is.NotErr(t, s.Restaurant.Save(r))
+	}
+
+	//I EXPECT every event stored with codec of its service
+	es, err := store.Events(context.Background(), 0, id)
+	is.NotErr(t, err)
+	var codecs []string
+	for _, e := range es {
+		codecs = append(codecs, e.Codec)
+	}
+	is.Equal(t, []string{"json", "msgpack", "msgpack", "protobuf", "gob"}, codecs)
+
+	//AND I EXPECT whole stream loaded by service knowing all codecs
+	r, err := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(store), cqrs.Codecs(codec.JSON, codec.All...)), people).Restaurant.Load(id)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(5), r.Root().Version)
+	is.Equal(t, "gob", r.Meal("Tom"))
+
+	//AND I EXPECT error from service which knows JSON only
+	_, err = cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(store)), people).Restaurant.Load(id)
+	is.Err(t, err, "msgpack codec is not registered")
+}
+
+func TestForgetPerson(t *testing.T) {
+	//WHEN Tom, Greg and Cindy choose their meals in PasiBus
+	store := cqrs.NewMemoryStorage()
+	s := cqrsexample.NewService(
+		cqrsexample.Repository(cqrs.Storage(store)),
+		cqrsexample.People(shred.NewMemoryKeys()))
+
+	restaurant := s.Restaurant.New()
+	is.NotErr(t, restaurant.Create("PasiBus", "dobre burgery", "BBQ", "Eggy"))
+	is.NotErr(t, restaurant.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, s.Restaurant.Save(restaurant))
+	for _, c := range [][2]string{{"Tom", "BBQ"}, {"Greg", "BBQ"}, {"Tom", "Eggy"}, {"Cindy", "Eggy"}} {
+		is.NotErr(t, restaurant.ChooseMeal(c[0], c[1]))
+		ctx := cqrs.WithMetadata(context.Background(), cqrs.Actor, c[0])
+		is.NotErr(t, s.Restaurant.SaveContext(ctx, restaurant))
+	}
+	id := restaurant.Root().ID
+
+	//I EXPECT no names of people in stored events, nor in their actors
+	es, err := store.Events(context.Background(), 0, id)
+	is.NotErr(t, err)
+	for _, e := range es {
+		for _, p := range []string{"Tom", "Greg", "Cindy"} {
+			is.True(t, !bytes.Contains(e.Data, []byte(p)), "plain text person stored")
+			is.True(t, !strings.Contains(e.Metadata[cqrs.Actor], p), "plain text actor stored")
+		}
+	}
+
+	//THEN Tom and Greg ask to be forgotten
+	tom, err := s.ForgetPerson("Tom")
+	is.NotErr(t, err)
+	greg, err := s.ForgetPerson("Greg")
+	is.NotErr(t, err)
+
+	//I EXPECT them forgotten as different people
+	is.True(t, shred.IsForgotten(tom), "%s is not forgotten", tom)
+	is.True(t, shred.IsForgotten(greg), "%s is not forgotten", greg)
+	is.True(t, tom != greg, "Tom and Greg forgotten as %s", tom)
+
+	//AND I EXPECT restaurant still loaded with their meals kept anonymously
+	r, err := s.Restaurant.Load(id)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(6), r.Root().Version)
+	is.Equal(t, "", r.Meal("Tom"))
+	is.Equal(t, "", r.Meal("Greg"))
+	is.Equal(t, "Eggy", r.Meal(tom))
+	is.Equal(t, "BBQ", r.Meal(greg))
+	is.Equal(t, "Eggy", r.Meal("Cindy"))
+
+	//AND I EXPECT them removed from read model, with their actions audited
+	//anonymously, also after rebuild
+	audit := func(actor string) []query.Record {
+		p, err := s.Query.Audit(cqrs.Actor, actor, query.List{})
+		is.NotErr(t, err)
+		return p.Records
+	}
+	for i := 0; i < 2; i++ {
+		_, ok := s.Query.People()["Tom"]
+		is.True(t, !ok, "Tom is still in read model")
+		_, ok = s.Query.People()["Greg"]
+		is.True(t, !ok, "Greg is still in read model")
+		_, ok = s.Query.People()["Cindy"]
+		is.True(t, ok, "Cindy is missing in read model")
+		is.Equal(t, 0, len(audit("Tom")))
+		is.Equal(t, 2, len(audit(tom)))
+		is.Equal(t, 1, len(audit(greg)))
+		is.Equal(t, 1, len(audit("Cindy")))
+
+		_, err = s.RebuildProjection(cqrsexample.QueryProjection)
+		is.NotErr(t, err)
+	}
+}
+
+func TestCatchUpSubscription(t *testing.T) {
+	//WHEN two restaurants are created before projection starts
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	for _, n := range []string{"PasiBus", "Zupa.pl"} {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(n, "", "BBQ"))
+		is.NotErr(t, s.Restaurant.Save(r))
+	}
+
+	//THEN I subscribe new projection to restaurant events
+	read, checkpoints := query.New(), cqrs.NewMemoryCheckpoints()
+	ctx, stop := context.WithCancel(context.Background())
+	sub := s.Subscribe("taverns", cqrs.Idempotent(read.ListenContext, read.Position),
+		checkpoints, cqrs.PollInterval(time.Hour))
+	done := make(chan error)
+	go func() { done <- sub.Run(ctx) }()
+
+	//I EXPECT it caught up with past events
+	eventually(t, func() bool { return sub.Position() == 2 })
+	is.Equal(t, 2, len(read.Taverns()))
+
+	//AND I EXPECT live events delivered without polling
+	r := s.Restaurant.New()
+	is.NotErr(t, r.Create("Gary", "", "Gyros"))
+	is.NotErr(t, s.Restaurant.Save(r))
+	eventually(t, func() bool { return sub.Position() == 3 })
+	is.Equal(t, 3, len(read.Taverns()))
+	is.Equal(t, "Gary", read.Taverns()[r.Root().String()].Name)
+
+	stop()
+	is.Err(t, <-done, "context canceled")
+
+	//THEN I run subscription again from the beginning
+	is.NotErr(t, checkpoints.Commit(context.Background(), "taverns", 0))
+	ctx, stop = context.WithCancel(context.Background())
+	defer stop()
+	go sub.Run(ctx)
+
+	//I EXPECT events delivered again ignored by idempotent projection
+	eventually(t, func() bool { return sub.Position() == 3 })
+	is.Equal(t, 3, len(read.Taverns()))
+	rs, err := read.Audit(cqrs.Actor, "", query.List{})
+	is.NotErr(t, err)
+	is.Equal(t, 3, len(rs.Records))
+	is.Equal(t, uint64(3), read.Position())
+}
+
+func TestRebuildProjection(t *testing.T) {
+	//WHEN read model lost restaurants which are in store
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	for _, n := range []string{"PasiBus", "Zupa.pl"} {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(n, "", "BBQ"))
+		is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+		is.NotErr(t, r.ChooseMeal("Tom", "BBQ"))
+		is.NotErr(t, s.Restaurant.Save(r))
+	}
+	s.Query.Swap(query.New())
+
+	//THEN I rebuild it in place
+	var batches int
+	r, err := s.RebuildProjection(cqrsexample.QueryProjection,
+		cqrsexample.Progress(func(cqrsexample.Rebuild) { batches++ }, 2))
+	is.NotErr(t, err)
+
+	//I EXPECT restaurants back with progress reported per batch
+	is.Equal(t, 2, len(s.Query.Taverns()))
+	is.Equal(t, 6, r.Events)
+	is.Equal(t, uint64(6), r.Position)
+	is.Equal(t, 3, batches)
+
+	//THEN I rebuild it in shadow, while restaurant is saved
+	r, err = s.RebuildProjection(cqrsexample.QueryProjection,
+		cqrsexample.Shadow(),
+		cqrsexample.Progress(func(p cqrsexample.Rebuild) {
+			if p.Events != 2 {
+				return
+			}
+			g := s.Restaurant.New()
+			is.NotErr(t, g.Create("Gary", "", "Gyros"))
+			is.NotErr(t, s.Restaurant.Save(g))
+			is.Equal(t, 3, len(s.Query.Taverns()))
+		}, 2))
+	is.NotErr(t, err)
+
+	//I EXPECT every event projected exactly once
+	is.True(t, r.Shadow, "shadow rebuild expected")
+	is.Equal(t, 7, r.Events)
+	is.Equal(t, 3, len(s.Query.Taverns()))
+	rs, err := s.Query.Audit(cqrs.Actor, "", query.List{})
+	is.NotErr(t, err)
+	is.Equal(t, 7, len(rs.Records))
+
+	//AND I EXPECT events saved after rebuild projected
+	g := s.Restaurant.New()
+	is.NotErr(t, g.Create("Zdrowe Gary", "", "Salad"))
+	is.NotErr(t, s.Restaurant.Save(g))
+	is.Equal(t, 4, len(s.Query.Taverns()))
+
+	_, err = s.RebuildProjection("unknown")
+	is.Err(t, err, "unknown projection not found")
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	friday := time.Now().UTC().Round(0).AddDate(0, 0, 7)
+	for friday.Weekday() != time.Friday {
+		friday = friday.AddDate(0, 0, 1)
+	}
+
+	//WHEN PasiBus is rescheduled to Friday and Zupa.pl is on the next day
+	pasiBus := s.Restaurant.New()
+	is.NotErr(t, pasiBus.Create("PasiBus", "dobre burgery", "BBQ", "Eggy"))
+	is.NotErr(t, pasiBus.Schedule(friday.AddDate(0, 0, -1)))
+	is.NotErr(t, s.Restaurant.Save(pasiBus))
+	is.NotErr(t, pasiBus.Schedule(friday))
+
+	zupa := s.Restaurant.New()
+	is.NotErr(t, zupa.Create("Zupa.pl", "", "Pomidorowa"))
+	is.NotErr(t, zupa.Schedule(friday.AddDate(0, 0, 1)))
+
+	//THEN Tom and Greg choose their meals, then Tom changes the meal
+	is.NotErr(t, pasiBus.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, pasiBus.ChooseMeal("Greg", "Eggy"))
+	is.NotErr(t, pasiBus.ChooseMeal("Tom", "Eggy"))
+	is.NotErr(t, zupa.ChooseMeal("Tom", "Pomidorowa"))
+	is.NotErr(t, s.Restaurant.Save(pasiBus))
+	is.NotErr(t, s.Restaurant.Save(zupa))
+
+	coming := func(on time.Time) []query.Subscriptions {
+		p, err := s.Query.Coming("PasiBus", on, query.List{})
+		is.NotErr(t, err)
+		return p.Subscriptions
+	}
+	eating := func(from, to time.Time) []query.Subscriptions {
+		p, err := s.Query.Eating("Tom", query.List{Filter: query.Filter{From: from, To: to}})
+		is.NotErr(t, err)
+		return p.Subscriptions
+	}
+
+	//I EXPECT Greg and Tom coming to PasiBus on Friday
+	ss := coming(friday)
+	is.Equal(t, 2, len(ss))
+	is.Equal(t, "Greg", ss[0].Person)
+	is.Equal(t, "Tom", ss[1].Person)
+	is.Equal(t, "Eggy", ss[1].Meal)
+	is.Equal(t, 0, len(coming(friday.AddDate(0, 0, -1))))
+
+	//AND I EXPECT what Tom is eating during the week of Friday
+	ss = eating(friday.AddDate(0, 0, -4), friday.AddDate(0, 0, 3))
+	is.Equal(t, 2, len(ss))
+	is.Equal(t, "PasiBus", ss[0].Tavern)
+	is.Equal(t, "Eggy", ss[0].Meal)
+	is.True(t, ss[0].On.Equal(friday), "Tom eats in PasiBus on other day")
+	is.Equal(t, "Zupa.pl", ss[1].Tavern)
+	is.Equal(t, s.Query.People()["Tom"].ID, ss[1].PersonID)
+	for _, v := range s.Query.Taverns() {
+		if v.UUID == zupa.Root().ID {
+			is.Equal(t, v.ID, ss[1].TavernID)
+		}
+	}
+	is.Equal(t, 1, len(eating(friday.AddDate(0, 0, 1), friday.AddDate(0, 0, 2))))
+
+	//AND I EXPECT same projection after rebuild
+	_, err := s.RebuildProjection(cqrsexample.QueryProjection)
+	is.NotErr(t, err)
+	is.Equal(t, ss, eating(friday.AddDate(0, 0, -4), friday.AddDate(0, 0, 3)))
+
+	//AND I EXPECT Tom gone once forgotten
+	_, err = s.ForgetPerson("Tom")
+	is.NotErr(t, err)
+	is.Equal(t, 0, len(eating(friday.AddDate(0, 0, -4), friday.AddDate(0, 0, 3))))
+	is.Equal(t, 1, len(coming(friday)))
+}
+
+func TestOrderSummary(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	on := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	//WHEN four people choose their meals in PasiBus
+	r := s.Restaurant.New()
+	is.NotErr(t, r.Create("PasiBus", "dobre burgery", "BBQ", "Eggy", "Gonzo"))
+	is.NotErr(t, r.Schedule(on))
+	for p, m := range map[string]string{"Tom": "Gonzo", "Greg": "Eggy", "Cindy": "Eggy", "Joanna": "BBQ"} {
+		is.NotErr(t, r.ChooseMeal(p, m))
+	}
+	is.NotErr(t, s.Restaurant.Save(r))
+
+	//THEN Tom and Joanna change their meals
+	is.NotErr(t, r.ChooseMeal("Tom", "Eggy"))
+	is.NotErr(t, r.ChooseMeal("Joanna", "Gonzo"))
+	is.NotErr(t, s.Restaurant.Save(r))
+
+	//I EXPECT current choices summed up by meal
+	o, err := s.Query.OrderSummary(r.Root().ID)
+	is.NotErr(t, err)
+	is.Equal(t, []query.Line{
+		{Meal: "Eggy", Count: 3, People: []string{"Cindy", "Greg", "Tom"}},
+		{Meal: "Gonzo", Count: 1, People: []string{"Joanna"}},
+	}, o.Lines)
+
+	//AND I EXPECT it rendered as text and JSON
+	is.Equal(t, "PasiBus, Fri 1 Mar 2030 12:00\n3x Eggy: Cindy, Greg, Tom\n1x Gonzo: Joanna\n", o.String())
+
+	b, err := json.Marshal(o)
+	is.NotErr(t, err)
+	is.Equal(t, `{"tavern":"PasiBus","on":"2030-03-01T12:00:00Z","lines":[`+
+		`{"meal":"Eggy","count":3,"people":["Cindy","Greg","Tom"]},`+
+		`{"meal":"Gonzo","count":1,"people":["Joanna"]}]}`, string(b))
+
+	_, err = s.Query.OrderSummary("unknown")
+	is.Err(t, err, "tavern unknown not found")
+}
+
+func TestCalendar(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	day := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	lunch := func(name string, days int, meal string) string {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(name, "dobre, tanie; polecam", meal))
+		is.NotErr(t, r.Schedule(day.AddDate(0, 0, days)))
+		is.NotErr(t, s.Restaurant.Save(r))
+
+		return r.Root().ID
+	}
+
+	//WHEN four lunches are scheduled, PasiBus is rescheduled and Bar is canceled
+	pasiBus, err := s.Restaurant.Load(lunch("PasiBus", 2, "BBQ"))
+	is.NotErr(t, err)
+	zupa, err := s.Restaurant.Load(lunch("Zupa.pl", 10, "Pomidorowa"))
+	is.NotErr(t, err)
+	bar, err := s.Restaurant.Load(lunch("Bar", 5, "Pierogi"))
+	is.NotErr(t, err)
+	lunch("Zdrowe Gary", 20, "Salad")
+	is.NotErr(t, pasiBus.Schedule(day.AddDate(0, 0, 3)))
+	is.NotErr(t, bar.Cancel("closed"))
+	is.NotErr(t, s.Restaurant.Save(pasiBus))
+	is.NotErr(t, s.Restaurant.Save(bar))
+
+	calendar := func(from, to time.Time) []query.Tavern {
+		p, err := s.Query.Calendar(query.List{Filter: query.Filter{From: from, To: to}})
+		is.NotErr(t, err)
+		return p.Taverns
+	}
+
+	//I EXPECT lunches of next two weeks ordered by time
+	ts := calendar(day, day.AddDate(0, 0, 14))
+	is.Equal(t, 2, len(ts))
+	is.Equal(t, "PasiBus", ts[0].Name)
+	is.Equal(t, 1, ts[0].Sequence)
+	is.Equal(t, "Zupa.pl", ts[1].Name)
+
+	//AND I EXPECT every later lunch without end of calendar
+	ts = calendar(day, time.Time{})
+	is.Equal(t, 3, len(ts))
+	is.Equal(t, "Zdrowe Gary", ts[2].Name)
+
+	//THEN Tom joins PasiBus and Zupa.pl
+	is.NotErr(t, pasiBus.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, zupa.ChooseMeal("Tom", "Pomidorowa"))
+	is.NotErr(t, s.Restaurant.Save(pasiBus))
+	is.NotErr(t, s.Restaurant.Save(zupa))
+
+	//I EXPECT both of them in Tom's calendar
+	ics := string(s.Query.ICalendar("Tom"))
+	is.True(t, strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"), "calendar expected:\n%s", ics)
+	is.True(t, strings.HasSuffix(ics, "END:VEVENT\r\nEND:VCALENDAR\r\n"), "calendar expected:\n%s", ics)
+	is.Equal(t, 2, strings.Count(ics, "BEGIN:VEVENT"))
+	for _, l := range []string{
+		"UID:" + pasiBus.Root().ID + "@cqrsexample\r\n",
+		"SEQUENCE:1\r\nDTSTART:20300304T120000Z\r\n",
+		"SUMMARY:PasiBus: BBQ\r\n",
+		"DESCRIPTION:dobre\\, tanie\\; polecam\r\n",
+		"SEQUENCE:0\r\nDTSTART:20300311T120000Z\r\n",
+	} {
+		is.True(t, strings.Contains(ics, l), "%q expected in:\n%s", l, ics)
+	}
+
+	//THEN Zupa.pl is canceled
+	is.NotErr(t, zupa.Cancel("no soup today"))
+	is.NotErr(t, s.Restaurant.Save(zupa))
+	is.Err(t, zupa.ChooseMeal("Greg", "Pomidorowa"), "canceled")
+
+	//I EXPECT it removed from calendar and Tom's feed
+	is.Equal(t, 1, len(calendar(day, day.AddDate(0, 0, 14))))
+	ics = string(s.Query.ICalendar("Tom"))
+	is.Equal(t, 1, strings.Count(ics, "BEGIN:VEVENT"))
+	is.True(t, !strings.Contains(ics, zupa.Root().ID), "canceled lunch in calendar:\n%s", ics)
+}
+
+func TestMealHistory(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	day := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	lunch := func(name string, days int, choices ...string) {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(name, "", "BBQ", "Eggy", "Gonzo"))
+		is.NotErr(t, r.Schedule(day.AddDate(0, 0, days)))
+		for _, m := range choices {
+			is.NotErr(t, r.ChooseMeal("Tom", m))
+		}
+		is.NotErr(t, s.Restaurant.Save(r))
+	}
+
+	//WHEN Tom eats in PasiBus twice and in Zupa.pl once, changing meals
+	lunch("PasiBus", 0, "BBQ", "Eggy", "Gonzo")
+	lunch("Zupa.pl", 1, "Eggy")
+	lunch("PasiBus", 7, "BBQ", "Eggy")
+	lunch("Zdrowe Gary", 14)
+
+	eaten := func(from time.Time) []query.Meal {
+		p, err := s.History.Eaten("Tom", query.List{Filter: query.Filter{From: from}})
+		is.NotErr(t, err)
+		return p.Meals
+	}
+
+	//I EXPECT every meal Tom has eaten, in order
+	ms := eaten(time.Time{})
+	is.Equal(t, 3, len(ms))
+	is.Equal(t, query.Meal{Person: "Tom", Tavern: "PasiBus", TavernUUID: ms[0].TavernUUID,
+		Meal: "Gonzo", On: day, Changes: 2}, ms[0])
+	is.Equal(t, "Zupa.pl", ms[1].Tavern)
+	is.Equal(t, "Eggy", ms[2].Meal)
+
+	//AND I EXPECT favorites of Tom
+	is.Equal(t, query.Stats{Meals: 3, Changes: 3, FavoriteTavern: "PasiBus", FavoriteMeal: "Eggy"},
+		s.History.Stats("Tom", time.Time{}, time.Time{}))
+
+	//AND I EXPECT them in given dates only
+	is.Equal(t, query.Stats{Meals: 2, Changes: 2, FavoriteTavern: "PasiBus", FavoriteMeal: "Eggy"},
+		s.History.Stats("Tom", day, day.AddDate(0, 0, 2)))
+	is.Equal(t, 1, len(eaten(day.AddDate(0, 0, 7))))
+
+	//AND I EXPECT same history after rebuild
+	_, err := s.RebuildProjection(cqrsexample.HistoryProjection, cqrsexample.Shadow())
+	is.NotErr(t, err)
+	is.Equal(t, ms, eaten(time.Time{}))
+	is.Equal(t, 4, len(s.Query.Taverns()))
+}
+
+func TestListPages(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	day := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	lunch := func(name string, days int, menu ...string) {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(name, "", menu...))
+		is.NotErr(t, r.Schedule(day.AddDate(0, 0, days)))
+		is.NotErr(t, r.ChooseMeal("Tom", menu[0]))
+		is.NotErr(t, s.Restaurant.Save(r))
+	}
+	names := func(ts []query.Tavern) []string {
+		var ns []string
+		for _, t := range ts {
+			ns = append(ns, t.Name)
+		}
+		return ns
+	}
+
+	//WHEN five taverns are scheduled, two of them with same name
+	lunch("PasiBus", 4, "BBQ", "Eggy")
+	lunch("Zupa.pl", 1, "Pomidorowa")
+	lunch("Bar", 3, "Pierogi", "BBQ")
+	lunch("PasiBus", 2, "Gonzo")
+	lunch("Zdrowe Gary", 0, "Salad")
+
+	//THEN I read them sorted by name, two per page
+	var all []query.Tavern
+	l := query.List{Sort: "name", Limit: 2}
+	for i := 0; ; i++ {
+		p, err := s.Query.ListTaverns(l)
+		is.NotErr(t, err)
+		all = append(all, p.Taverns...)
+		if p.Next == "" {
+			break
+		}
+		l.After = p.Next
+
+		//AND new tavern appears between pages
+		if i == 0 {
+			lunch("Arka", 5, "Ryba")
+		}
+	}
+
+	//I EXPECT every tavern exactly once, equal names ordered by id
+	is.Equal(t, []string{"Bar", "PasiBus", "PasiBus", "Zdrowe Gary", "Zupa.pl"}, names(all))
+	is.True(t, all[1].ID < all[2].ID, "taverns with equal names not ordered by id")
+
+	//AND I EXPECT taverns filtered and ordered by time, descending
+	p, err := s.Query.ListTaverns(query.List{
+		Filter: query.Filter{Menu: "bbq", From: day.AddDate(0, 0, 1)},
+		Sort:   "-on",
+	})
+	is.NotErr(t, err)
+	is.Equal(t, []string{"PasiBus", "Bar"}, names(p.Taverns))
+
+	p, err = s.Query.ListTaverns(query.List{Filter: query.Filter{Name: "zu", To: day.AddDate(0, 0, 2)}})
+	is.NotErr(t, err)
+	is.Equal(t, []string{"Zupa.pl"}, names(p.Taverns))
+
+	//AND I EXPECT other lists paged same way
+	ss, err := s.Query.ListSubscriptions(query.List{Filter: query.Filter{Name: "pasi"}, Limit: 1})
+	is.NotErr(t, err)
+	is.Equal(t, 1, len(ss.Subscriptions))
+	is.Equal(t, day.AddDate(0, 0, 2), ss.Subscriptions[0].On)
+	ss, err = s.Query.ListSubscriptions(query.List{Filter: query.Filter{Name: "pasi"}, After: ss.Next})
+	is.NotErr(t, err)
+	is.Equal(t, "", ss.Next)
+	is.Equal(t, day.AddDate(0, 0, 4), ss.Subscriptions[0].On)
+
+	ms, err := s.History.ListMeals(query.List{Filter: query.Filter{Name: "pasi"}, Sort: "-meal"})
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(ms.Meals))
+	is.Equal(t, "Gonzo", ms.Meals[0].Meal)
+	is.Equal(t, "BBQ", ms.Meals[1].Meal)
+
+	ps, err := s.Query.ListPeople(query.List{})
+	is.NotErr(t, err)
+	is.Equal(t, []query.Person{{ID: 0, Name: "Tom"}}, ps.People)
+
+	rs, err := s.Query.ListRecords(query.List{Filter: query.Filter{Name: "created"}, Sort: "-at", Limit: 3})
+	is.NotErr(t, err)
+	is.Equal(t, 3, len(rs.Records))
+	is.True(t, rs.Next != "", "next page of records expected")
+
+	//AND I EXPECT read models of single person or tavern paged as well
+	cs, err := s.Query.Calendar(query.List{Filter: query.Filter{From: day.AddDate(0, 0, 1)}, Limit: 2})
+	is.NotErr(t, err)
+	is.Equal(t, []string{"Zupa.pl", "PasiBus"}, names(cs.Taverns))
+	cs, err = s.Query.Calendar(query.List{Filter: query.Filter{From: day.AddDate(0, 0, 1)}, Limit: 2, After: cs.Next})
+	is.NotErr(t, err)
+	is.Equal(t, []string{"Bar", "PasiBus"}, names(cs.Taverns))
+
+	ss, err = s.Query.Eating("Tom", query.List{Sort: "-on", Limit: 1})
+	is.NotErr(t, err)
+	is.Equal(t, "Arka", ss.Subscriptions[0].Tavern)
+	ss, err = s.Query.Coming("PasiBus", day.AddDate(0, 0, 2), query.List{Sort: "meal"})
+	is.NotErr(t, err)
+	is.Equal(t, 1, len(ss.Subscriptions))
+	is.Equal(t, "Gonzo", ss.Subscriptions[0].Meal)
+
+	ms, err = s.History.Eaten("Tom", query.List{Sort: "tavern", Limit: 1})
+	is.NotErr(t, err)
+	is.Equal(t, "Arka", ms.Meals[0].Tavern)
+	ms, err = s.History.Eaten("Tom", query.List{Sort: "tavern", Limit: 1, After: ms.Next})
+	is.NotErr(t, err)
+	is.Equal(t, "Bar", ms.Meals[0].Tavern)
+
+	rs, err = s.Query.Audit(cqrs.Actor, "", query.List{Filter: query.Filter{Name: "scheduled"}, Limit: 4})
+	is.NotErr(t, err)
+	is.Equal(t, 4, len(rs.Records))
+	rs, err = s.Query.Audit(cqrs.Actor, "", query.List{Filter: query.Filter{Name: "scheduled"}, After: rs.Next})
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(rs.Records))
+	is.Equal(t, "", rs.Next)
+
+	_, err = s.Query.ListTaverns(query.List{Sort: "menu"})
+	is.Err(t, err, "sort by menu not supported")
+	_, err = s.Query.ListTaverns(query.List{Sort: "-name", After: all[0].Name})
+	is.Err(t, err, "not valid")
+	_, err = s.Query.ListTaverns(query.List{Sort: "on", After: l.After})
+	is.Err(t, err, "not valid")
+}
+
+func TestSearch(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	for _, r := range [][]string{
+		{"PasiBus", "dobre burgery", "BBQ", "Eggy"},
+		{"Zdrowe Gary", "polskie jedzenie", "Ogórkowa", "Schabowy", "Pierogi"},
+		{"Burger Bar", "", "Cheeseburger", "Frytki"},
+	} {
+		a := s.Restaurant.New()
+		is.NotErr(t, a.Create(r[0], r[1], r[2:]...))
+		is.NotErr(t, s.Restaurant.Save(a))
+	}
+	names := func(ts []query.Tavern) []string {
+		var ns []string
+		for _, t := range ts {
+			ns = append(ns, t.Name)
+		}
+		return ns
+	}
+	search := func(text string, limit int) []query.Tavern {
+		p, err := s.Query.Search(text, query.List{Limit: limit})
+		is.NotErr(t, err)
+		return p.Taverns
+	}
+
+	//WHEN I search for burger
+	//I EXPECT restaurant named so before one with burgers in info
+	is.Equal(t, []string{"Burger Bar", "PasiBus"}, names(search("burger", 0)))
+	is.Equal(t, []string{"Burger Bar"}, names(search("Burger", 1)))
+	p, err := s.Query.Search("burger", query.List{Limit: 1})
+	is.NotErr(t, err)
+	p, err = s.Query.Search("burger", query.List{Limit: 1, After: p.Next})
+	is.NotErr(t, err)
+	is.Equal(t, []string{"PasiBus"}, names(p.Taverns))
+	is.Equal(t, "", p.Next)
+
+	//AND I EXPECT diacritics and case ignored, words matched by prefix
+	is.Equal(t, []string{"Zdrowe Gary"}, names(search("ogorkowa", 0)))
+	is.Equal(t, []string{"Zdrowe Gary"}, names(search("OGÓR", 0)))
+	is.Equal(t, []string{"Zdrowe Gary"}, names(search("pol pier", 0)))
+
+	//AND I EXPECT every word matched
+	is.Equal(t, []string{"PasiBus"}, names(search("dobre burg", 0)))
+	is.Equal(t, 0, len(search("dobre frytki", 0)))
+	is.Equal(t, 0, len(search("", 0)))
+}
+
+func TestAsynchronousProjections(t *testing.T) {
+	s := cqrsexample.NewService(
+		cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())),
+		cqrsexample.Asynchronous(cqrs.Workers(3), cqrs.QueueSize(2)))
+	defer s.Close()
+
+	//WHEN restaurants are saved and changed many times
+	var last uint64
+	var ids []string
+	for i := 0; i < 10; i++ {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(fmt.Sprintf("Tavern %d", i), "", "Gyros"))
+		is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+		is.NotErr(t, s.Restaurant.Save(r))
+		is.NotErr(t, r.ChooseMeal("Tom", "Gyros"))
+		is.NotErr(t, r.ChooseMeal("Tom", "Salad"))
+		is.NotErr(t, s.Restaurant.Save(r))
+		last, ids = r.Root().Position, append(ids, r.Root().ID)
+	}
+
+	//THEN I wait for position of last save
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	is.NotErr(t, s.WaitFor(ctx, last))
+
+	//I EXPECT every event projected in order of saves
+	is.Equal(t, uint64(40), last)
+	is.Equal(t, last, s.Query.Position())
+	is.Equal(t, 10, len(s.Query.Taverns()))
+	for _, id := range ids {
+		o, err := s.Query.OrderSummary(id)
+		is.NotErr(t, err)
+		is.Equal(t, "Salad", o.Lines[0].Meal)
+	}
+	is.Equal(t, cqrs.AsyncStats{}, s.ProjectionLag())
+
+	//AND I EXPECT waiting for position which is never saved canceled
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	is.Err(t, s.WaitFor(ctx, last+1), "deadline exceeded")
+}
+
+func TestAsynchronousConcurrentSaves(t *testing.T) {
+	//WHEN handler of one restaurant holds it after it is stored, before
+	//it is queued for projections
+	blocked, release := make(chan struct{}), make(chan struct{})
+	hold := func(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event, ds []interface{}) {
+		if c, ok := ds[0].(*events.Created); ok && c.Restaurant == "Slow" {
+			close(blocked)
+			<-release
+		}
+	}
+	s := cqrsexample.NewService(
+		cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage()), cqrs.EventContextHandler(hold)),
+		cqrsexample.Asynchronous())
+	defer s.Close()
+
+	saved := make(chan error)
+	go func() {
+		r := s.Restaurant.New()
+		if err := r.Create("Slow", "", "Gyros"); err != nil {
+			saved <- err
+			return
+		}
+		saved <- s.Restaurant.Save(r)
+	}()
+	<-blocked
+
+	//THEN other restaurant is saved concurrently, at later position
+	r := s.Restaurant.New()
+	is.NotErr(t, r.Create("Fast", "", "Gyros"))
+	is.NotErr(t, s.Restaurant.Save(r))
+	is.Equal(t, uint64(2), r.Root().Position)
+
+	//I EXPECT waiting for its position lasts until earlier one is projected
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	is.Err(t, s.WaitFor(ctx, r.Root().Position), "deadline exceeded")
+
+	close(release)
+	is.NotErr(t, <-saved)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	is.NotErr(t, s.WaitFor(ctx, r.Root().Position))
+	is.Equal(t, 2, len(s.Query.Taverns()))
+}
+
+func TestAsynchronousSavesOfOneRestaurant(t *testing.T) {
+	//WHEN restaurant is held after it is stored, before it is queued for
+	//projections
+	day := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	created, scheduled, release := make(chan string), make(chan struct{}), make(chan struct{})
+	hold := func(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event, ds []interface{}) {
+		switch ds[0].(type) {
+		case *events.Created:
+			created <- a.ID
+			<-release
+		case *events.Scheduled:
+			close(scheduled)
+		}
+	}
+	s := cqrsexample.NewService(
+		cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage()), cqrs.EventContextHandler(hold)),
+		cqrsexample.Asynchronous())
+	defer s.Close()
+
+	saved := make(chan error, 2)
+	go func() {
+		r := s.Restaurant.New()
+		if err := r.Create("PasiBus", "", "Gyros"); err != nil {
+			saved <- err
+			return
+		}
+		saved <- s.Restaurant.Save(r)
+	}()
+	id := <-created
+
+	//THEN it is loaded, scheduled and saved again meanwhile
+	r, err := s.Restaurant.Load(id)
+	is.NotErr(t, err)
+	is.NotErr(t, r.Schedule(day))
+	go func() { saved <- s.Restaurant.Save(r) }()
+	<-scheduled
+	// give its events a chance to overtake ones saved before
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	is.NotErr(t, <-saved)
+	is.NotErr(t, <-saved)
+
+	//I EXPECT restaurant projected created and then scheduled
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	is.NotErr(t, s.WaitFor(ctx, r.Root().Position))
+	ts := s.Query.Taverns()
+	is.Equal(t, 1, len(ts))
+	for _, v := range ts {
+		is.True(t, v.On.Equal(day), "tavern scheduled before it was created")
+	}
+}
+
+func TestAsyncHandler(t *testing.T) {
+	//WHEN handler is slow and panics on some aggregate
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := map[string][]uint64{}
+	a := cqrs.NewAsync(func(ctx context.Context, ag cqrs.CQRSAggregate, es []cqrs.Event, _ []interface{}) {
+		<-release
+		if ag.ID == "panic" {
+			panic("projection is broken")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range es {
+			handled[ag.ID] = append(handled[ag.ID], e.Version)
+		}
+	}, cqrs.Workers(2), cqrs.QueueSize(8))
+
+	//THEN events are handled
+	for p := uint64(1); p <= 6; p++ {
+		id := []string{"a", "b", "panic"}[p%3]
+		a.Handle(context.Background(), cqrs.CQRSAggregate{ID: id}, []cqrs.Event{{Version: p, Position: p}}, nil)
+	}
+
+	//I EXPECT them queued, without waiting for handler
+	is.Equal(t, uint64(0), a.Position())
+	is.Equal(t, uint64(6), a.Stats().Lag)
+	is.Equal(t, 6, a.Stats().Queued)
+
+	//AND I EXPECT every aggregate handled in order, despite panics
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	is.NotErr(t, a.WaitFor(ctx, 6))
+	a.Close()
+
+	is.Equal(t, map[string][]uint64{"a": {3, 6}, "b": {1, 4}}, handled)
+	is.Equal(t, cqrs.AsyncStats{Panics: 2}, a.Stats())
+}
+
+func TestDeadLetters(t *testing.T) {
+	//WHEN mailer fails twice on every restaurant and always on Zupa.pl
+	dead := cqrs.NewMemoryDeadLetters()
+	attempts := map[string]int{}
+	mailer := func(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event, ds []interface{}) error {
+		attempts[a.ID]++
+		if c, ok := ds[0].(*events.Created); ok && c.Restaurant == "Zupa.pl" || attempts[a.ID] < 3 {
+			return fmt.Errorf("smtp is down")
+		}
+
+		return nil
+	}
+	s := cqrsexample.NewService(cqrsexample.Repository(
+		cqrs.Storage(cqrs.NewMemoryStorage()),
+		cqrs.EventContextHandler(cqrs.Retry("mailer", mailer, dead,
+			cqrs.Attempts(3), cqrs.Backoff(time.Millisecond, 2*time.Millisecond)))))
+
+	var ids []string
+	for _, n := range []string{"PasiBus", "Zupa.pl", "Zupa.pl"} {
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create(n, "", "BBQ"))
+		is.NotErr(t, s.Restaurant.Save(r))
+		ids = append(ids, r.Root().ID)
+	}
+
+	//I EXPECT PasiBus handled on third attempt and Zupa.pl in dead letters
+	ls, err := dead.List(context.Background(), "mailer")
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(ls))
+	is.Equal(t, ids[1], ls[0].Aggregate.ID)
+	is.Equal(t, "smtp is down", ls[0].Error)
+	is.Equal(t, 3, ls[0].Attempts)
+	is.Equal(t, events.CreatedName, ls[0].Events[0].Type)
+	is.Equal(t, 3, attempts[ids[0]])
+
+	//THEN I redeliver first of them, while mail is still failing
+	is.Err(t, s.Redeliver(context.Background(), dead, ls[0].ID, mailer), "smtp is down")
+	l, err := dead.Get(context.Background(), ls[0].ID)
+	is.NotErr(t, err)
+	is.Equal(t, 4, l.Attempts)
+
+	//AND I redeliver it with fixed mailer and discard the other one
+	var redelivered []interface{}
+	is.NotErr(t, s.Redeliver(context.Background(), dead, ls[0].ID,
+		func(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event, ds []interface{}) error {
+			redelivered = ds
+			return nil
+		}))
+	is.NotErr(t, dead.Delete(context.Background(), ls[1].ID))
+
+	//I EXPECT decoded events redelivered and no dead letters left
+	is.Equal(t, "Zupa.pl", redelivered[0].(*events.Created).Restaurant)
+	ls, err = dead.List(context.Background(), "")
+	is.NotErr(t, err)
+	is.Equal(t, 0, len(ls))
+	is.Err(t, dead.Delete(context.Background(), l.ID), "not found")
+}
+
+func TestForgetPersonInDeadLetters(t *testing.T) {
+	//WHEN mailer always fails on meals chosen by Tom
+	keys, dead := shred.NewMemoryKeys(), cqrs.NewMemoryDeadLetters()
+	mailer := func(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event, ds []interface{}) error {
+		return fmt.Errorf("smtp is down")
+	}
+	s := cqrsexample.NewService(
+		cqrsexample.Repository(
+			cqrs.Storage(cqrs.NewMemoryStorage()),
+			cqrs.EventContextHandler(cqrs.Retry("mailer", mailer, shred.DeadLetters(dead, keys),
+				cqrs.Attempts(1)))),
+		cqrsexample.People(keys))
+
+	r := s.Restaurant.New()
+	is.NotErr(t, r.Create("PasiBus", "", "BBQ"))
+	is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, s.Restaurant.Save(r))
+	is.NotErr(t, r.ChooseMeal("Tom", "BBQ"))
+	ctx := cqrs.WithMetadata(context.Background(), cqrs.Actor, "Tom")
+	is.NotErr(t, s.Restaurant.SaveContext(ctx, r))
+
+	//I EXPECT no Tom in dead letters, nor in their actors
+	ls, err := dead.List(context.Background(), "mailer")
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(ls))
+	e := ls[1].Events[0]
+	is.True(t, !bytes.Contains(e.Data, []byte("Tom")), "plain text person in dead letter")
+	is.True(t, !strings.Contains(e.Metadata[cqrs.Actor], "Tom"), "plain text actor in dead letter")
+
+	l, err := shred.DeadLetters(dead, keys).Get(context.Background(), ls[1].ID)
+	is.NotErr(t, err)
+	is.Equal(t, "Tom", l.Events[0].Metadata[cqrs.Actor])
+
+	//THEN Tom asks to be forgotten
+	tom, err := s.ForgetPerson("Tom")
+	is.NotErr(t, err)
+
+	//I EXPECT him forgotten in dead letters too
+	ls, err = shred.DeadLetters(dead, keys).List(context.Background(), "mailer")
+	is.NotErr(t, err)
+	is.Equal(t, tom, ls[1].Events[0].Metadata[cqrs.Actor])
+}
+
+func TestWatch(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	day := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	kinds := func(ch <-chan query.Change) []query.ChangeKind {
+		var ks []query.ChangeKind
+		for {
+			select {
+			case c, ok := <-ch:
+				if !ok {
+					return append(ks, "closed")
+				}
+				ks = append(ks, c.Kind)
+			default:
+				return ks
+			}
+		}
+	}
+
+	//WHEN I watch PasiBus and other watchers have small buffers
+	changes, cancel := s.Query.Watch(query.Filter{Name: "pasi"})
+	oldest, cancelOldest := s.Query.Watch(query.Filter{}, query.Buffer(2))
+	defer cancelOldest()
+	slow, cancelSlow := s.Query.Watch(query.Filter{}, query.Buffer(2), query.OnFull(query.Disconnect))
+	defer cancelSlow()
+
+	//THEN PasiBus is rescheduled and Tom changes meal, while Zupa.pl is created
+	pasiBus := s.Restaurant.New()
+	is.NotErr(t, pasiBus.Create("PasiBus", "", "BBQ", "Eggy"))
+	is.NotErr(t, pasiBus.Schedule(day))
+	is.NotErr(t, s.Restaurant.Save(pasiBus))
+	zupa := s.Restaurant.New()
+	is.NotErr(t, zupa.Create("Zupa.pl", "", "Pomidorowa"))
+	is.NotErr(t, s.Restaurant.Save(zupa))
+	is.NotErr(t, pasiBus.Schedule(day.AddDate(0, 0, 1)))
+	is.NotErr(t, pasiBus.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, pasiBus.ChooseMeal("Tom", "Eggy"))
+	is.NotErr(t, s.Restaurant.Save(pasiBus))
+
+	//I EXPECT changes of PasiBus only, in order
+	c := <-changes
+	is.Equal(t, query.TavernCreated, c.Kind)
+	is.Equal(t, "PasiBus", c.Tavern.Name)
+	is.Equal(t, []query.ChangeKind{query.TavernScheduled, query.TavernRescheduled,
+		query.MealSelected, query.MealChanged}, kinds(changes))
+	cancel()
+
+	//AND I EXPECT oldest changes dropped for watcher with small buffer
+	oc := <-oldest
+	is.Equal(t, query.MealSelected, oc.Kind)
+	oc = <-oldest
+	is.Equal(t, query.Change{Kind: query.MealChanged, Tavern: oc.Tavern, Person: "Tom",
+		Meal: "Eggy", Previous: "BBQ", Position: 6}, oc)
+	is.True(t, oc.Tavern.On.Equal(day.AddDate(0, 0, 1)), "rescheduled tavern expected")
+
+	//AND I EXPECT slow watcher disconnected
+	is.Equal(t, []query.ChangeKind{query.TavernCreated, query.TavernScheduled, "closed"}, kinds(slow))
+	_, ok := <-changes
+	is.True(t, !ok, "canceled watch not closed")
+}
+
+func TestWatchWithoutBuffer(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		//WHEN I watch with buffer of given size
+		s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+		changes, cancel := s.Query.Watch(query.Filter{}, query.Buffer(n))
+
+		//THEN restaurant is created and scheduled
+		r := s.Restaurant.New()
+		is.NotErr(t, r.Create("PasiBus", "", "BBQ"))
+		is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+		is.NotErr(t, s.Restaurant.Save(r))
+
+		//I EXPECT buffer of one change, with latest one
+		is.Equal(t, query.TavernScheduled, (<-changes).Kind)
+		cancel()
+	}
+}
+
+func TestConcurrentSaveAndQueries(t *testing.T) {
+	s := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(cqrs.NewMemoryStorage())))
+	shared := s.Restaurant.New()
+	is.NotErr(t, shared.Create("PasiBus", "", "BBQ", "Eggy"))
+	is.NotErr(t, shared.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, s.Restaurant.Save(shared))
+
+	//WHEN restaurants are saved and read model is queried in parallel
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	errs, shares := make(chan error, 8*5), make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			r := s.Restaurant.New()
+			errs <- r.Create(fmt.Sprintf("Tavern %d", i), "", "Gyros")
+			errs <- r.Schedule(time.Now().Add(24 * time.Hour))
+			errs <- r.ChooseMeal(fmt.Sprintf("person %d", i), "Gyros")
+			errs <- s.Restaurant.Save(r)
+
+			r, err := s.Restaurant.Load(shared.Root().ID)
+			if err == nil {
+				err = r.ChooseMeal(fmt.Sprintf("guest %d", i), "BBQ")
+			}
+			errs <- err
+			if err == nil {
+				shares <- s.Restaurant.Save(r)
+			}
+		}(i)
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				//AND callers change what they got
+				for k, v := range s.Query.Taverns() {
+					v.Menu[0] = "changed"
+					delete(s.Query.Taverns(), k)
+				}
+				for k := range s.Query.People() {
+					s.Query.People()[k] = query.Person{}
+				}
+				rs, _ := s.Query.Audit(cqrs.Actor, "", query.List{})
+				for _, r := range rs.Records {
+					r.Metadata[cqrs.Actor] = "changed"
+				}
+				s.Query.Position()
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	close(shares)
+
+	//I EXPECT every save of own restaurant done
+	for err := range errs {
+		is.NotErr(t, err)
+	}
+
+	//AND I EXPECT saves of shared restaurant done or rejected as stale
+	guests := 0
+	for err := range shares {
+		if err == nil {
+			guests++
+			continue
+		}
+		is.True(t, strings.Contains(err.Error(), "version missmatch"),
+			"version missmatch expected, got %s", err)
+	}
+	is.True(t, guests > 0, "no guest saved in shared restaurant")
+
+	//AND I EXPECT every restaurant and person projected, untouched by callers
+	ts := s.Query.Taverns()
+	is.Equal(t, 9, len(ts))
+	for _, v := range ts {
+		is.True(t, v.Menu[0] != "changed", "read model changed by caller")
+	}
+	is.Equal(t, 8+guests, len(s.Query.People()))
+	rs, err := s.Query.Audit(cqrs.Actor, "changed", query.List{})
+	is.NotErr(t, err)
+	for _, r := range rs.Records {
+		t.Fatalf("read model changed by caller: %v", r)
+	}
+}
+
+// eventually waits until ok is true, test fails after 2 seconds.
+func eventually(t *testing.T, ok func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if ok() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("condition not met in 2 seconds")
+}
+
 func TestScenario(t *testing.T) {
 
 	pasiBus := service.Restaurant.New()
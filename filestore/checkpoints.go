@@ -0,0 +1,67 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+type checkpoints struct {
+	dir string
+}
+
+type checkpoint struct {
+	Position uint64 `json:"position"`
+}
+
+// NewCheckpoints keeps checkpoints of subscriptions in dir, every one of
+// them in its own file, which is replaced atomically on commit. They suit
+// projections which state is durable too, projection kept in memory would
+// skip events after restart.
+func NewCheckpoints(dir string) (cqrs.Checkpoints, error) {
+	if err := mkdir(dir); err != nil {
+		return nil, err
+	}
+
+	return &checkpoints{dir: dir}, nil
+}
+
+func (c *checkpoints) Checkpoint(ctx context.Context, name string) (uint64, error) {
+	if !named(name) {
+		return 0, fmt.Errorf("filestore: invalid checkpoint name %q", name)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, name+".json"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var p checkpoint
+	if err := decode(bytes.TrimSuffix(b, []byte("\n")), &p); err != nil {
+		return 0, fmt.Errorf("filestore: %s checkpoint: %s", name, err)
+	}
+
+	return p.Position, nil
+}
+
+func (c *checkpoints) Commit(ctx context.Context, name string, position uint64) error {
+	if !named(name) {
+		return fmt.Errorf("filestore: invalid checkpoint name %q", name)
+	}
+
+	b, err := json.Marshal(checkpoint{Position: position})
+	if err != nil {
+		return err
+	}
+
+	return write(c.dir, name+".json", encode(b))
+}
@@ -0,0 +1,105 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+type deadLetters struct {
+	dir string
+}
+
+// NewDeadLetters keeps dead letters in dir, every one of them in its own
+// file named by its ID. Events are kept as handler got them, wrap it with
+// transform.NewDeadLetters when stored events are transformed.
+func NewDeadLetters(dir string) (cqrs.DeadLetters, error) {
+	if err := mkdir(dir); err != nil {
+		return nil, err
+	}
+
+	return &deadLetters{dir: dir}, nil
+}
+
+func (d *deadLetters) Put(ctx context.Context, l cqrs.DeadLetter) error {
+	if !named(l.ID) {
+		return fmt.Errorf("filestore: invalid dead letter id %q", l.ID)
+	}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return write(d.dir, l.ID+".json", encode(b))
+}
+
+func (d *deadLetters) List(ctx context.Context, handler string) ([]cqrs.DeadLetter, error) {
+	fs, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := []cqrs.DeadLetter{}
+	for _, f := range fs {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		l, err := d.Get(ctx, strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		if handler == "" || l.Handler == handler {
+			ls = append(ls, l)
+		}
+	}
+	cqrs.SortDeadLetters(ls)
+
+	return ls, nil
+}
+
+func (d *deadLetters) Get(ctx context.Context, id string) (cqrs.DeadLetter, error) {
+	var l cqrs.DeadLetter
+	if !named(id) {
+		return l, fmt.Errorf("dead letter %s not found", id)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(d.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return l, fmt.Errorf("dead letter %s not found", id)
+	}
+	if err != nil {
+		return l, err
+	}
+
+	if err := decode(bytes.TrimSuffix(b, []byte("\n")), &l); err != nil {
+		return l, fmt.Errorf("filestore: %s dead letter: %s", id, err)
+	}
+
+	return l, nil
+}
+
+func (d *deadLetters) Delete(ctx context.Context, id string) error {
+	if _, err := d.Get(ctx, id); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(d.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return syncDir(d.dir)
+}
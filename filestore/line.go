@@ -0,0 +1,39 @@
+package filestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// encode returns line of log, it is CRC-32C checksum of b in hex, space, b
+// and new line.
+func encode(b []byte) []byte {
+	l := make([]byte, 0, len(b)+10)
+	l = append(l, fmt.Sprintf("%08x ", crc32.Checksum(b, table))...)
+	l = append(l, b...)
+
+	return append(l, '\n')
+}
+
+// decode verifies checksum of line (without new line) and unmarshals it
+// into v.
+func decode(line []byte, v interface{}) error {
+	if len(line) < 9 || line[8] != ' ' {
+		return fmt.Errorf("malformed line")
+	}
+
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return fmt.Errorf("malformed checksum")
+	}
+
+	if uint32(sum) != crc32.Checksum(line[9:], table) {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	return json.Unmarshal(line[9:], v)
+}
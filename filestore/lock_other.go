@@ -0,0 +1,14 @@
+//go:build !unix
+
+package filestore
+
+import "os"
+
+// lock is not supported, store must not be shared by many processes.
+func lock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,614 @@
+// Package filestore is cqrs.Store which keeps events on disk, in append only
+// segments of checksummed JSON lines. Every Save is written as a single line
+// and synced before it returns, so it is either stored as a whole or not at
+// all. A line torn by a crash is cut off when store is opened again.
+//
+// Many processes might share same directory, writes are serialized by file
+// lock, and every process catches up with lines appended by others before
+// it checks aggregate version, so optimistic concurrency holds among them.
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/gokit/log"
+)
+
+// Store keeps index of aggregates in memory, event data is read from
+// segments when it is needed.
+type Store struct {
+	mu   sync.Mutex
+	dir  string
+	size int64
+	lock *os.File
+
+	aggregates map[string]cqrs.CQRSAggregate
+	streams    map[string][]location
+	all        []location
+
+	// position in log up to which index is built, and global position of
+	// last event in it.
+	segment  int
+	offset   int64
+	position uint64
+}
+
+// location of a commit line in log.
+type location struct {
+	segment int
+	offset  int64
+	length  int
+	last    uint64 // version of last event in commit
+	first   uint64 // global position of first event in commit
+	events  int
+}
+
+// commit is a single line of log.
+type commit struct {
+	Aggregate cqrs.CQRSAggregate `json:"aggregate"`
+	Events    []entry            `json:"events"`
+}
+
+type entry struct {
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Schema   uint          `json:"schema,omitempty"`
+	Codec    string        `json:"codec,omitempty"`
+	Data     []byte        `json:"data"`
+	Version  uint64        `json:"version"`
+	Created  time.Time     `json:"created"`
+	Metadata cqrs.Metadata `json:"metadata,omitempty"`
+}
+
+func (e entry) event(position uint64) cqrs.Event {
+	return cqrs.Event{
+		ID:       e.ID,
+		Type:     e.Type,
+		Schema:   e.Schema,
+		Codec:    e.Codec,
+		Data:     e.Data,
+		Version:  e.Version,
+		Created:  e.Created,
+		Metadata: e.Metadata,
+		Position: position,
+	}
+}
+
+type snapshot struct {
+	Aggregate string `json:"aggregate"`
+	Version   uint64 `json:"version"`
+	Data      []byte `json:"data"`
+}
+
+type Option func(*Store)
+
+// SegmentSize limits size of segment in bytes, next segment is started when
+// commit does not fit in current one. Default is 64MB.
+func SegmentSize(n int64) Option {
+	return func(s *Store) {
+		s.size = n
+	}
+}
+
+// Open store kept in dir, it is created when it does not exist. Log is
+// read in order to build index, torn tail of last segment is truncated.
+func Open(dir string, os ...Option) (*Store, error) {
+	s := &Store{
+		dir:        dir,
+		size:       64 << 20,
+		aggregates: map[string]cqrs.CQRSAggregate{},
+		streams:    map[string][]location{},
+		segment:    1,
+	}
+	for _, o := range os {
+		o(s)
+	}
+
+	if err := mkdir(filepath.Join(dir, "snapshots")); err != nil {
+		return nil, err
+	}
+
+	l, err := openFile(filepath.Join(dir, "LOCK"))
+	if err != nil {
+		return nil, err
+	}
+	s.lock = l
+
+	err = s.locked(true, func() error { return s.refresh(true) })
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close releases lock file, store can not be used afterwards.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lock.Close()
+}
+
+func (s *Store) Save(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c := commit{Aggregate: a, Events: make([]entry, len(es))}
+	for i, e := range es {
+		c.Events[i] = entry{
+			ID:       e.ID,
+			Type:     e.Type,
+			Schema:   e.Schema,
+			Codec:    e.Codec,
+			Data:     e.Data,
+			Version:  e.Version,
+			Created:  e.Created,
+			Metadata: e.Metadata,
+		}
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	line := encode(b)
+
+	return s.locked(true, func() error {
+		if err := s.refresh(true); err != nil {
+			return err
+		}
+
+		// check if aggregate has not been changed by other request or
+		// other process!
+		if l := s.aggregates[a.ID]; a.Version-uint64(len(es)) != l.Version {
+			return fmt.Errorf(
+				"%s version missmatch, arrived: %d, expects: %d",
+				a.Type, a.Version, l.Version)
+		}
+
+		segment, offset := s.segment, s.offset
+		if s.offset > 0 && s.offset+int64(len(line)) > s.size {
+			s.segment, s.offset = s.segment+1, 0
+		}
+
+		if err := s.append(line); err != nil {
+			s.segment, s.offset = segment, offset
+			return err
+		}
+
+		s.index(c, location{segment: s.segment, offset: s.offset, length: len(line)})
+		s.offset += int64(len(line))
+		for i := range es {
+			es[i].Position = s.position - uint64(len(es)) + uint64(i) + 1
+		}
+
+		return nil
+	})
+}
+
+func (s *Store) Load(ctx context.Context, id string) (cqrs.CQRSAggregate, error) {
+	if err := ctx.Err(); err != nil {
+		return cqrs.CQRSAggregate{}, err
+	}
+
+	var a cqrs.CQRSAggregate
+	err := s.locked(false, func() error {
+		if err := s.refresh(false); err != nil {
+			return err
+		}
+
+		var ok bool
+		if a, ok = s.aggregates[id]; !ok {
+			return fmt.Errorf("aggregate %s not found", id)
+		}
+
+		return nil
+	})
+
+	return a, err
+}
+
+func (s *Store) Events(ctx context.Context, version uint64, id string) ([]cqrs.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var es []cqrs.Event
+	err := s.locked(false, func() error {
+		if err := s.refresh(false); err != nil {
+			return err
+		}
+
+		for _, l := range s.streams[id] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if l.last <= version {
+				continue
+			}
+
+			c, err := s.read(l)
+			if err != nil {
+				return err
+			}
+
+			for i, e := range c.Events {
+				if e.Version <= version {
+					continue
+				}
+
+				es = append(es, e.event(l.first+uint64(i)))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+// ReadAll finds first commit after position by binary search in index of
+// log, then reads commits one by one.
+func (s *Store) ReadAll(ctx context.Context, position uint64, limit int, f cqrs.Filter) ([]cqrs.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var rs []cqrs.Record
+	err := s.locked(false, func() error {
+		if err := s.refresh(false); err != nil {
+			return err
+		}
+
+		n := sort.Search(len(s.all), func(i int) bool {
+			return s.all[i].first+uint64(s.all[i].events) > position+1
+		})
+
+		for _, l := range s.all[n:] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			c, err := s.read(l)
+			if err != nil {
+				return err
+			}
+
+			for i, e := range c.Events {
+				p := l.first + uint64(i)
+				if p <= position || !f.Match(e.Type, c.Aggregate.Type) {
+					continue
+				}
+
+				if limit > 0 && len(rs) == limit {
+					return nil
+				}
+
+				rs = append(rs, cqrs.Record{
+					Event: e.event(p),
+					Aggregate: cqrs.CQRSAggregate{
+						ID:      c.Aggregate.ID,
+						Type:    c.Aggregate.Type,
+						Version: e.Version,
+					},
+				})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (s *Store) Last(ctx context.Context, kind string, frequency uint) ([]cqrs.CQRSAggregate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var o []cqrs.CQRSAggregate
+	err := s.locked(false, func() error {
+		if err := s.refresh(false); err != nil {
+			return err
+		}
+
+		for _, a := range s.aggregates {
+			if a.Type != kind {
+				continue
+			}
+
+			sv, _ := s.snapshot(a.ID)
+			if uint(a.Version-sv) < frequency {
+				continue
+			}
+
+			o = append(o, cqrs.CQRSAggregate{
+				ID:      a.ID,
+				Version: sv,
+				Type:    a.Type,
+			})
+		}
+
+		return nil
+	})
+
+	return o, err
+}
+
+// Make replaces snapshot file atomically.
+func (s *Store) Make(ctx context.Context, n cqrs.Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(snapshot{
+		Aggregate: n.AggregateID,
+		Version:   n.Version,
+		Data:      n.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return write(filepath.Join(s.dir, "snapshots"), n.AggregateID+".json", encode(b))
+}
+
+// Snapshot which is damaged is treated as missing one, aggregate is
+// rebuilt from its events then.
+func (s *Store) Snapshot(ctx context.Context, id string) (uint64, []byte) {
+	v, data := s.snapshot(id)
+	if data == nil {
+		return 0, []byte{}
+	}
+
+	return v, data
+}
+
+func (s *Store) snapshot(id string) (uint64, []byte) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, "snapshots", id+".json"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		log.Error("filestore.snapshot", err)
+		return 0, nil
+	}
+
+	var n snapshot
+	if err = decode(bytes.TrimSuffix(b, []byte("\n")), &n); err != nil {
+		log.Error("filestore.snapshot", fmt.Errorf("%s: %s", id, err))
+		return 0, nil
+	}
+
+	return n.Version, n.Data
+}
+
+// locked runs fn with store mutex and file lock held, exclusive one is
+// required when log is written or repaired.
+func (s *Store) locked(exclusive bool, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := lock(s.lock, exclusive); err != nil {
+		return err
+	}
+	defer unlock(s.lock)
+
+	return fn()
+}
+
+// refresh reads lines appended to log since last refresh (ie. by other
+// processes) into index. Torn line at the end of log is truncated when
+// repair is set, otherwise it is left as it is for a writer to repair.
+func (s *Store) refresh(repair bool) error {
+	for {
+		f, err := os.Open(s.path(s.segment))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		torn, err := s.scan(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		next := s.path(s.segment + 1)
+		if _, err := os.Stat(next); os.IsNotExist(err) {
+			if torn && repair {
+				log.Info("filestore.repair", "%s truncated to %d bytes",
+					s.path(s.segment), s.offset)
+				return os.Truncate(s.path(s.segment), s.offset)
+			}
+
+			return nil
+		}
+
+		if torn {
+			return fmt.Errorf("filestore: %s is corrupted at %d byte",
+				s.path(s.segment), s.offset)
+		}
+
+		s.segment, s.offset = s.segment+1, 0
+	}
+}
+
+// scan indexes lines of segment from current offset, it stops at first
+// line which is not complete or has invalid checksum and reports it as
+// torn. Torn line followed by other lines means corrupted segment.
+func (s *Store) scan(f *os.File) (torn bool, err error) {
+	if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return len(b) > 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		var c commit
+		if err := decode(b[:len(b)-1], &c); err != nil {
+			if _, err := r.Peek(1); err == io.EOF {
+				return true, nil
+			}
+
+			return false, fmt.Errorf("filestore: %s is corrupted at %d byte: %s",
+				f.Name(), s.offset, err)
+		}
+
+		s.index(c, location{segment: s.segment, offset: s.offset, length: len(b)})
+		s.offset += int64(len(b))
+	}
+}
+
+// index commit, global positions of events follow order of lines in log,
+// so they are same in every process.
+func (s *Store) index(c commit, l location) {
+	if n := len(c.Events); n > 0 {
+		l.last = c.Events[n-1].Version
+	}
+	l.first, l.events = s.position+1, len(c.Events)
+	s.position += uint64(len(c.Events))
+
+	s.aggregates[c.Aggregate.ID] = c.Aggregate
+	s.streams[c.Aggregate.ID] = append(s.streams[c.Aggregate.ID], l)
+	s.all = append(s.all, l)
+}
+
+func (s *Store) read(l location) (commit, error) {
+	var c commit
+
+	f, err := os.Open(s.path(l.segment))
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	b := make([]byte, l.length)
+	if _, err := f.ReadAt(b, l.offset); err != nil {
+		return c, err
+	}
+
+	return c, decode(b[:len(b)-1], &c)
+}
+
+// append writes line at the end of current segment and syncs it, directory
+// is synced too when segment is created.
+func (s *Store) append(line []byte) error {
+	_, err := os.Stat(s.path(s.segment))
+	created := os.IsNotExist(err)
+
+	f, err := os.OpenFile(s.path(s.segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if created {
+		return syncDir(s.dir)
+	}
+
+	return nil
+}
+
+func (s *Store) path(segment int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.log", segment))
+}
+
+// write replaces file in dir atomically, data is written to temporary file
+// first and then renamed.
+func write(dir, name string, data []byte) error {
+	f, err := ioutil.TempFile(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// named tells whether name (ie. id of dead letter) can name file in
+// directory, it must not point outside of it.
+func named(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`)
+}
+
+func mkdir(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
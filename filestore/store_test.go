@@ -0,0 +1,264 @@
+package filestore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sokool/cqrsexample"
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/cqrs/storetest"
+	"github.com/sokool/cqrsexample/filestore"
+	"github.com/sokool/gokit/test/is"
+)
+
+var ctx = context.Background()
+
+func open(t *testing.T, dir string, os ...filestore.Option) *filestore.Store {
+	s, err := filestore.Open(dir, os...)
+	is.NotErr(t, err)
+
+	return s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filestore")
+	is.NotErr(t, err)
+
+	return dir
+}
+
+func TestSaveAndReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I save 3 commits into small segments and reopen store
+	s := open(t, dir, filestore.SegmentSize(512))
+	is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 1, 2))
+	is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 3, 3))
+	is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 4, 6))
+	expected, err := s.Events(ctx, 0, storetest.ID)
+	is.NotErr(t, err)
+	is.NotErr(t, s.Close())
+
+	s = open(t, dir, filestore.SegmentSize(512))
+	defer s.Close()
+
+	//I EXPECT events in many segments
+	ss, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	is.NotErr(t, err)
+	is.True(t, len(ss) > 1, "many segments expected")
+
+	//AND I EXPECT same events and aggregate after reopen
+	es, err := s.Events(ctx, 0, storetest.ID)
+	is.NotErr(t, err)
+	is.Equal(t, expected, es)
+
+	a, err := s.Load(ctx, storetest.ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(6), a.Version)
+}
+
+func TestVersionCheckAcrossStores(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN two stores (ie. processes) share same directory
+	a, b := open(t, dir), open(t, dir)
+	defer a.Close()
+	defer b.Close()
+
+	//THEN both of them append to same aggregate
+	is.NotErr(t, storetest.Save(a, storetest.ID, "restaurant", 1, 2))
+	is.NotErr(t, storetest.Save(b, storetest.ID, "restaurant", 3, 3))
+
+	//I EXPECT second one rejected, when it does not know about third event
+	is.Err(t, storetest.Save(a, storetest.ID, "restaurant", 3, 3), "version missmatch")
+
+	//AND I EXPECT all events seen by both of them
+	for _, s := range []*filestore.Store{a, b} {
+		es, err := s.Events(ctx, 0, storetest.ID)
+		is.NotErr(t, err)
+		is.Equal(t, 3, len(es))
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	for _, tail := range []string{`0badc0de {"aggregate":`, "0badc0de {}\n"} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := open(t, dir)
+		is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 1, 2))
+		is.NotErr(t, s.Close())
+
+		segment := filepath.Join(dir, "00000001.log")
+		good, err := ioutil.ReadFile(segment)
+		is.NotErr(t, err)
+
+		//WHEN process crashed while writing a line
+		is.NotErr(t, ioutil.WriteFile(segment, append(good, tail...), 0644))
+
+		//THEN I open store again
+		s = open(t, dir)
+
+		//I EXPECT torn line truncated
+		b, err := ioutil.ReadFile(segment)
+		is.NotErr(t, err)
+		is.Equal(t, good, b)
+
+		//AND I EXPECT store working
+		is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 3, 3))
+		es, err := s.Events(ctx, 0, storetest.ID)
+		is.NotErr(t, err)
+		is.Equal(t, 3, len(es))
+		is.NotErr(t, s.Close())
+	}
+}
+
+func TestCorruptedSegment(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := open(t, dir)
+	is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 1, 2))
+	is.NotErr(t, storetest.Save(s, storetest.ID, "restaurant", 3, 3))
+	is.NotErr(t, s.Close())
+
+	//WHEN first line is damaged
+	segment := filepath.Join(dir, "00000001.log")
+	b, err := ioutil.ReadFile(segment)
+	is.NotErr(t, err)
+	b[20] ^= 0xff
+	is.NotErr(t, ioutil.WriteFile(segment, b, 0644))
+
+	//I EXPECT error instead of losing events which follow it
+	_, err = filestore.Open(dir)
+	is.Err(t, err, "corrupted")
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (cqrs.Store, func()) {
+		dir := tempDir(t)
+		s := open(t, dir, filestore.SegmentSize(512))
+
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestService(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I save restaurant with service using file store
+	s := open(t, dir)
+	service := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(s)))
+	r := service.Restaurant.New()
+	is.NotErr(t, r.Create("PasiBus", "dobre burgery", "BBQ", "Eggy"))
+	is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, service.Restaurant.Save(r))
+	is.NotErr(t, s.Close())
+
+	//I EXPECT it loaded after restart
+	s = open(t, dir)
+	defer s.Close()
+	r, err := cqrsexample.NewService(cqrsexample.Repository(cqrs.Storage(s))).
+		Restaurant.Load(r.Root().ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(2), r.Root().Version)
+}
+
+func TestReadAllAcrossStores(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN two stores append events of two aggregates into small segments
+	a, b := open(t, dir, filestore.SegmentSize(512)), open(t, dir, filestore.SegmentSize(512))
+	defer a.Close()
+	defer b.Close()
+
+	is.NotErr(t, storetest.Save(a, storetest.ID, "restaurant", 1, 2))
+	is.NotErr(t, storetest.Save(b, storetest.Other, "person", 1, 1))
+	es := storetest.Events(storetest.ID, 3, 3)
+	is.NotErr(t, a.Save(ctx, cqrs.CQRSAggregate{ID: storetest.ID, Type: "restaurant", Version: 3}, es))
+
+	//I EXPECT positions assigned in commit order of both of them
+	is.Equal(t, uint64(4), es[0].Position)
+
+	//AND I EXPECT same global log read by both of them
+	for _, s := range []*filestore.Store{a, b} {
+		rs, err := s.ReadAll(ctx, 0, 0, cqrs.Filter{})
+		is.NotErr(t, err)
+		is.Equal(t, 4, len(rs))
+		for i, r := range rs {
+			is.Equal(t, uint64(i+1), r.Position)
+		}
+		is.Equal(t, storetest.Other, rs[2].Aggregate.ID)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I put two dead letters of different handlers
+	d, err := filestore.NewDeadLetters(dir)
+	is.NotErr(t, err)
+	at := time.Now().Round(0)
+	es := []cqrs.Event{{ID: storetest.ID, Type: "restaurant.created", Version: 1, Data: []byte(`{}`)}}
+	is.NotErr(t, d.Put(ctx, cqrs.DeadLetter{ID: "b", Handler: "mailer", Events: es, Failed: at.Add(time.Second)}))
+	is.NotErr(t, d.Put(ctx, cqrs.DeadLetter{ID: "a", Handler: "search", Error: "down", Failed: at}))
+
+	//I EXPECT them listed after restart, in order of failure
+	d, err = filestore.NewDeadLetters(dir)
+	is.NotErr(t, err)
+	ls, err := d.List(ctx, "")
+	is.NotErr(t, err)
+	is.Equal(t, 2, len(ls))
+	is.Equal(t, "a", ls[0].ID)
+	is.Equal(t, es, ls[1].Events)
+
+	ls, err = d.List(ctx, "mailer")
+	is.NotErr(t, err)
+	is.Equal(t, 1, len(ls))
+
+	//AND I EXPECT discarded one gone
+	is.NotErr(t, d.Delete(ctx, "a"))
+	_, err = d.Get(ctx, "a")
+	is.Err(t, err, "dead letter a not found")
+	is.Err(t, d.Delete(ctx, "../a"), "not found")
+	is.Err(t, d.Put(ctx, cqrs.DeadLetter{ID: "../a"}), "invalid dead letter id")
+}
+
+func TestCheckpoints(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I commit checkpoint of subscription
+	c, err := filestore.NewCheckpoints(dir)
+	is.NotErr(t, err)
+	p, err := c.Checkpoint(ctx, "taverns")
+	is.NotErr(t, err)
+	is.Equal(t, uint64(0), p)
+	is.NotErr(t, c.Commit(ctx, "taverns", 42))
+
+	//I EXPECT it read after restart
+	c, err = filestore.NewCheckpoints(dir)
+	is.NotErr(t, err)
+	p, err = c.Checkpoint(ctx, "taverns")
+	is.NotErr(t, err)
+	is.Equal(t, uint64(42), p)
+
+	//AND I EXPECT names which point outside of dir rejected
+	for _, n := range []string{"", "../taverns", `..\taverns`, "a/b"} {
+		_, err = c.Checkpoint(ctx, n)
+		is.Err(t, err, "invalid checkpoint name")
+		is.Err(t, c.Commit(ctx, n, 42), "invalid checkpoint name")
+	}
+}
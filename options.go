@@ -0,0 +1,54 @@
+package cqrsexample
+
+import (
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/shred"
+)
+
+// Option configures Service.
+type Option func(*options)
+
+type options struct {
+	repository []cqrs.Option
+	people     shred.Keys
+	async      []cqrs.AsyncOption
+}
+
+// Repository passes os to restaurant repository, ie.
+// Repository(cqrs.Codecs(codec.MessagePack, codec.All...)) changes format
+// of stored events.
+func Repository(os ...cqrs.Option) Option {
+	return func(o *options) {
+		o.repository = append(o.repository, os...)
+	}
+}
+
+// People keeps keys which protect names of people in stored events, by
+// default they are kept in memory.
+func People(k shred.Keys) Option {
+	return func(o *options) {
+		o.people = k
+	}
+}
+
+// Asynchronous projections are updated by their own workers, so Save does
+// not wait for them, see Service.WaitFor. By default they are updated by
+// Save.
+func Asynchronous(os ...cqrs.AsyncOption) Option {
+	return func(o *options) {
+		o.async = append([]cqrs.AsyncOption{}, os...)
+	}
+}
+
+func newOptions(os ...Option) *options {
+	o := &options{}
+	for _, fn := range os {
+		fn(o)
+	}
+
+	if o.people == nil {
+		o.people = shred.NewMemoryKeys()
+	}
+
+	return o
+}
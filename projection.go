@@ -0,0 +1,123 @@
+package cqrsexample
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/query"
+	"github.com/sokool/gokit/log"
+)
+
+// Names of projections kept by Service.
+const (
+	QueryProjection   = "query"   // Service.Query
+	HistoryProjection = "history" // Service.History
+)
+
+// Rebuild reports progress of projection rebuild.
+type Rebuild struct {
+	Projection string
+	Shadow     bool
+	Events     int           // replayed so far
+	Position   uint64        // of last replayed event in global log
+	Took       time.Duration // so far
+}
+
+type RebuildOption func(*rebuild)
+
+type rebuild struct {
+	shadow   bool
+	batch    int
+	progress func(Rebuild)
+}
+
+// Shadow builds projection next to the live one, which is still updated
+// and queried, and swaps them when new one is done. Without it projection
+// is reset and then replayed in place, new events are not applied to it
+// until rebuild is done.
+func Shadow() RebuildOption {
+	return func(r *rebuild) {
+		r.shadow = true
+	}
+}
+
+// Progress is called after every batch of replayed events. It must not
+// save restaurants during rebuild in place, they wait for it to finish.
+func Progress(fn func(Rebuild), batch int) RebuildOption {
+	return func(r *rebuild) {
+		r.progress, r.batch = fn, batch
+	}
+}
+
+// RebuildProjection of given name, see RebuildProjectionContext.
+func (s *Service) RebuildProjection(name string, os ...RebuildOption) (Rebuild, error) {
+	return s.RebuildProjectionContext(context.Background(), name, os...)
+}
+
+// RebuildProjectionContext resets projection and replays every stored
+// restaurant event through it. When it fails projection rebuilt in place
+// is left incomplete, shadow one is dropped and live one is kept.
+func (s *Service) RebuildProjectionContext(ctx context.Context, name string, os ...RebuildOption) (Rebuild, error) {
+	o := &rebuild{batch: 100, progress: func(Rebuild) {}}
+	for _, fn := range os {
+		fn(o)
+	}
+
+	r := Rebuild{Projection: name, Shadow: o.shadow}
+
+	// next is handler of new projection, swap makes it live.
+	var live, next cqrs.ContextHandlerFunc
+	var swap func()
+	switch name {
+	case QueryProjection:
+		n := query.New()
+		live, next, swap = s.Query.ListenContext, n.ListenContext, func() { s.Query.Swap(n) }
+	case HistoryProjection:
+		n := query.NewHistory()
+		live, next, swap = s.History.ListenContext, n.ListenContext, func() { s.History.Swap(n) }
+	default:
+		return r, fmt.Errorf("%s projection not found", name)
+	}
+
+	start := time.Now()
+	if !o.shadow {
+		s.projection.Lock()
+		defer s.projection.Unlock()
+		swap()
+		next = live
+	}
+
+	replay := func() error {
+		for {
+			p, n, err := s.Restaurant.repository.Replay(ctx, r.Position, o.batch, next)
+			if err != nil || n == 0 {
+				return err
+			}
+
+			r.Position, r.Events, r.Took = p, r.Events+n, time.Since(start)
+			o.progress(r)
+		}
+	}
+
+	if err := replay(); err != nil {
+		return r, err
+	}
+
+	if o.shadow {
+		// events saved meanwhile are caught up while live ones wait.
+		s.projection.Lock()
+		defer s.projection.Unlock()
+		if err := replay(); err != nil {
+			return r, err
+		}
+		swap()
+	}
+
+	s.rebuilt[name], r.Took = r.Position, time.Since(start)
+	log.Info("cqrsexample.projection.rebuild", "%s with %d events in %s",
+		name, r.Events, r.Took)
+
+	return r, nil
+}
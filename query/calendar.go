@@ -0,0 +1,95 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Calendar returns taverns scheduled in time range of l, To is open ended
+// when zero, ie. lunches in next two weeks. Taverns are filtered by name
+// and menu item as well, sort keys are on (default) and name. Taverns
+// which are not scheduled or are canceled are skipped.
+func (q *Query) Calendar(l List) (TavernPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.listTaverns(l, []string{"on", "name"}, func(t Tavern) map[string]string {
+		if t.On.IsZero() || t.Canceled {
+			return nil
+		}
+
+		return tavernKeys(t)
+	})
+}
+
+// ICalendar renders every lunch person joined as RFC 5545 calendar, which
+// can be subscribed to in calendar applications. Lunch keeps its UID, so
+// it is moved when tavern is rescheduled and disappears once tavern is
+// canceled.
+func (q *Query) ICalendar(person string) []byte {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	taverns := map[int]string{}
+	for id, t := range q.taverns {
+		taverns[t.ID] = id
+	}
+
+	var b ical
+	b.line("BEGIN:VCALENDAR")
+	b.line("VERSION:2.0")
+	b.line("PRODID:-//sokool//cqrsexample//EN")
+	b.line("CALSCALE:GREGORIAN")
+	b.line("X-WR-CALNAME:" + escape("Lunches of "+person))
+
+	// default sort of list is always supported
+	ss, _ := q.eating(person, List{})
+	for _, s := range ss.Subscriptions {
+		id := taverns[s.TavernID]
+		t := q.taverns[id]
+
+		b.line("BEGIN:VEVENT")
+		b.line("UID:" + id + "@cqrsexample")
+		b.line("DTSTAMP:" + stamp(t.Updated))
+		b.line("SEQUENCE:" + fmt.Sprint(t.Sequence))
+		b.line("DTSTART:" + stamp(s.On))
+		b.line("DURATION:PT1H")
+		b.line("SUMMARY:" + escape(s.Tavern+": "+s.Meal))
+		if t.Info != "" {
+			b.line("DESCRIPTION:" + escape(t.Info))
+		}
+		b.line("END:VEVENT")
+	}
+	b.line("END:VCALENDAR")
+
+	return []byte(b.String())
+}
+
+// ical builds content lines, which are terminated with CRLF and folded
+// when they are longer than 75 octets.
+type ical struct {
+	strings.Builder
+}
+
+func (b *ical) line(s string) {
+	for n := 75; len(s) > n; n = 74 {
+		i := n
+		for i > 0 && s[i]&0xc0 == 0x80 {
+			i-- // UTF-8 sequence is not split
+		}
+
+		b.WriteString(s[:i] + "\r\n ")
+		s = s[i:]
+	}
+
+	b.WriteString(s + "\r\n")
+}
+
+func stamp(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,178 @@
+package query
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/cqrsexample/shred"
+)
+
+// Meal eaten by person in tavern scheduled on given time, Changes tells
+// how many times person changed mind before.
+type Meal struct {
+	Person     string
+	Tavern     string
+	TavernUUID string
+	Meal       string
+	On         time.Time
+	Changes    int
+}
+
+// Stats of person's meals, favorites are the most frequent ones, ties are
+// resolved by name.
+type Stats struct {
+	Meals          int
+	Changes        int
+	FavoriteTavern string
+	FavoriteMeal   string
+}
+
+type lunch struct {
+	name     string
+	on       time.Time
+	canceled bool
+}
+
+// History is projection of every meal chosen by people, it is safe for
+// concurrent use.
+type History struct {
+	mu      sync.RWMutex
+	lunches map[string]lunch           // tavern UUID -> lunch
+	meals   map[string]map[string]Meal // person -> tavern UUID -> meal
+
+	position uint64
+}
+
+func NewHistory() *History {
+	return &History{
+		lunches: map[string]lunch{},
+		meals:   map[string]map[string]Meal{},
+	}
+}
+
+func (h *History) Listen(a cqrs.CQRSAggregate, ce []cqrs.Event, es []interface{}) {
+	h.ListenContext(context.Background(), a, ce, es)
+}
+
+func (h *History) ListenContext(ctx context.Context, a cqrs.CQRSAggregate, ce []cqrs.Event, es []interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range ce {
+		if e.Position > h.position {
+			h.position = e.Position
+		}
+	}
+
+	l := h.lunches[a.ID]
+	for _, event := range es {
+		switch e := event.(type) {
+		case *events.Created:
+			l.name = e.Restaurant
+		case *events.Scheduled:
+			l.on = e.On
+		case *events.Rescheduled:
+			l.on = e.On
+		case *events.Canceled:
+			l.canceled = true
+		case *events.MealSelected:
+			h.choose(a.ID, l, e.Person, e.Meal, false)
+		case *events.MealChanged:
+			h.choose(a.ID, l, e.Person, e.NewMeal, true)
+		}
+	}
+	h.lunches[a.ID] = l
+
+	for _, ms := range h.meals {
+		if m, ok := ms[a.ID]; ok {
+			m.Tavern, m.On = l.name, l.on
+			ms[a.ID] = m
+		}
+	}
+}
+
+func (h *History) choose(tavern string, l lunch, person, meal string, changed bool) {
+	if shred.IsForgotten(person) {
+		return
+	}
+
+	if h.meals[person] == nil {
+		h.meals[person] = map[string]Meal{}
+	}
+
+	m := h.meals[person][tavern]
+	if changed {
+		m.Changes++
+	}
+
+	m.Person, m.Tavern, m.TavernUUID, m.Meal, m.On = person, l.name, tavern, meal, l.on
+	h.meals[person][tavern] = m
+}
+
+// Swap replaces state of h with state of n, n must not be used anymore.
+func (h *History) Swap(n *History) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lunches, h.meals, h.position = n.lunches, n.meals, n.position
+}
+
+// Position of last applied event in global log.
+func (h *History) Position() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.position
+}
+
+// Eaten returns meals of person in taverns scheduled in time range of l,
+// To is open ended when zero. They are filtered and sorted as in
+// ListMeals, canceled lunches are skipped, nobody ate there.
+func (h *History) Eaten(person string, l List) (MealPage, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.listMeals(l, func(m Meal) bool { return m.Person == person })
+}
+
+// Stats of meals which person has eaten from given time until to.
+func (h *History) Stats(person string, from, to time.Time) Stats {
+	var s Stats
+	taverns, meals := map[string]int{}, map[string]int{}
+	// default sort of list is always supported
+	ms, _ := h.Eaten(person, List{Filter: Filter{From: from, To: to}})
+	for _, m := range ms.Meals {
+		s.Meals++
+		s.Changes += m.Changes
+		taverns[m.Tavern]++
+		meals[m.Meal]++
+	}
+
+	s.FavoriteTavern, s.FavoriteMeal = favorite(taverns), favorite(meals)
+
+	return s
+}
+
+// Forget removes meals of person.
+func (h *History) Forget(person string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.meals, person)
+}
+
+func favorite(counts map[string]int) string {
+	var f string
+	for k, n := range counts {
+		if n > counts[f] || n == counts[f] && k < f {
+			f = k
+		}
+	}
+
+	return f
+}
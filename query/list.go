@@ -0,0 +1,371 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filter of list, zero fields do not filter. Every list documents which
+// of them it uses.
+type Filter struct {
+	Name string    // contains, case is ignored
+	From time.Time // scheduled at or after
+	To   time.Time // scheduled before
+	Menu string    // has menu item, case is ignored
+}
+
+func (f Filter) name(ns ...string) bool {
+	if f.Name == "" {
+		return true
+	}
+
+	for _, n := range ns {
+		if strings.Contains(strings.ToLower(n), strings.ToLower(f.Name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f Filter) on(t time.Time) bool {
+	if f.From.IsZero() && f.To.IsZero() {
+		return true
+	}
+
+	return !t.IsZero() && !t.Before(f.From) && (f.To.IsZero() || t.Before(f.To))
+}
+
+func (f Filter) menu(items ...string) bool {
+	if f.Menu == "" {
+		return true
+	}
+
+	for _, i := range items {
+		if strings.EqualFold(i, f.Menu) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// List tells which page of list is read. Sort is one of sort keys of list,
+// prefixed with - for descending order, items with equal keys are ordered
+// by their identity, so order is stable among pages. After is cursor
+// returned with previous page, Limit 0 returns all items.
+type List struct {
+	Filter
+	Sort  string
+	Limit int
+	After string
+}
+
+// row is list item with its identity and values of its sort keys.
+type row struct {
+	id   string
+	keys map[string]string
+}
+
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+// paginate orders rows by sort key of l, sorts keys are supported ones and
+// first of them is default. It returns indexes of rows on page and cursor
+// of next page, which is empty on last one.
+func paginate(l List, sorts []string, rs []row) ([]int, string, error) {
+	if l.Sort == "" {
+		l.Sort = sorts[0]
+	}
+
+	key, desc := strings.TrimPrefix(l.Sort, "-"), strings.HasPrefix(l.Sort, "-")
+	supported := false
+	for _, s := range sorts {
+		supported = supported || s == key
+	}
+	if !supported {
+		return nil, "", fmt.Errorf("sort by %s not supported", key)
+	}
+
+	// before tells if (k1, id1) goes before (k2, id2).
+	before := func(k1, id1, k2, id2 string) bool {
+		if k1 != k2 {
+			return k1 < k2 != desc
+		}
+
+		return id1 < id2
+	}
+
+	is := make([]int, len(rs))
+	for i := range is {
+		is[i] = i
+	}
+	sort.Slice(is, func(a, b int) bool {
+		ra, rb := rs[is[a]], rs[is[b]]
+		return before(ra.keys[key], ra.id, rb.keys[key], rb.id)
+	})
+
+	if l.After != "" {
+		var c cursor
+		b, err := base64.RawURLEncoding.DecodeString(l.After)
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.Sort != l.Sort {
+			return nil, "", fmt.Errorf("cursor %s is not valid", l.After)
+		}
+
+		n := sort.Search(len(is), func(i int) bool {
+			r := rs[is[i]]
+			return before(c.Key, c.ID, r.keys[key], r.id)
+		})
+		is = is[n:]
+	}
+
+	if l.Limit <= 0 || len(is) <= l.Limit {
+		return is, "", nil
+	}
+
+	is = is[:l.Limit]
+	last := rs[is[len(is)-1]]
+	b, err := json.Marshal(cursor{Sort: l.Sort, Key: last.keys[key], ID: last.id})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return is, base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sortable formats of sort keys.
+func number(n int) string       { return fmt.Sprintf("%020d", n) }
+func moment(t time.Time) string { return t.UTC().Format("2006-01-02T15:04:05.000000000") }
+
+type TavernPage struct {
+	Taverns []Tavern
+	Next    string
+}
+
+// ListTaverns filtered by name, scheduled time and menu item. Sort keys
+// are id (default), name and on.
+func (q *Query) ListTaverns(l List) (TavernPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.listTaverns(l, []string{"id", "name", "on"}, func(t Tavern) map[string]string {
+		return tavernKeys(t)
+	})
+}
+
+// listTaverns pages taverns which pass filter of l, keys returns sort keys
+// of tavern or nil when tavern is skipped.
+func (q *Query) listTaverns(l List, sorts []string, keys func(Tavern) map[string]string) (TavernPage, error) {
+	var ts []Tavern
+	var rs []row
+	for _, t := range q.taverns {
+		if !l.name(t.Name) || !l.on(t.On) || !l.menu(t.Menu...) {
+			continue
+		}
+
+		ks := keys(t)
+		if ks == nil {
+			continue
+		}
+
+		t.Menu = append([]string(nil), t.Menu...)
+		ts = append(ts, t)
+		rs = append(rs, row{id: number(t.ID), keys: ks})
+	}
+
+	is, next, err := paginate(l, sorts, rs)
+	p := TavernPage{Taverns: make([]Tavern, len(is)), Next: next}
+	for n, i := range is {
+		p.Taverns[n] = ts[i]
+	}
+
+	return p, err
+}
+
+func tavernKeys(t Tavern) map[string]string {
+	return map[string]string{
+		"id":   number(t.ID),
+		"name": t.Name,
+		"on":   moment(t.On),
+	}
+}
+
+type PersonPage struct {
+	People []Person
+	Next   string
+}
+
+// ListPeople filtered by name. Sort keys are id (default) and name.
+func (q *Query) ListPeople(l List) (PersonPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var ps []Person
+	var rs []row
+	for _, p := range q.people {
+		if !l.name(p.Name) {
+			continue
+		}
+
+		ps = append(ps, p)
+		rs = append(rs, row{id: number(p.ID), keys: map[string]string{
+			"id":   number(p.ID),
+			"name": p.Name,
+		}})
+	}
+
+	is, next, err := paginate(l, []string{"id", "name"}, rs)
+	p := PersonPage{People: make([]Person, len(is)), Next: next}
+	for n, i := range is {
+		p.People[n] = ps[i]
+	}
+
+	return p, err
+}
+
+type SubscriptionPage struct {
+	Subscriptions []Subscriptions
+	Next          string
+}
+
+// ListSubscriptions filtered by name of person or tavern, scheduled time
+// and meal. Sort keys are on (default), person and tavern, canceled
+// taverns are skipped.
+func (q *Query) ListSubscriptions(l List) (SubscriptionPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.listSubscriptions(l, []string{"on", "person", "tavern"}, func(string, Subscriptions) bool {
+		return true
+	})
+}
+
+// listSubscriptions pages subscriptions which pass filter of l and which
+// keep tells to keep, it gets UUID of tavern too. Canceled taverns are
+// skipped.
+func (q *Query) listSubscriptions(l List, sorts []string, keep func(string, Subscriptions) bool) (SubscriptionPage, error) {
+	var ss []Subscriptions
+	var rs []row
+	for id, ps := range q.subscriptions {
+		if q.taverns[id].Canceled {
+			continue
+		}
+
+		for _, s := range ps {
+			if !l.name(s.Person, s.Tavern) || !l.on(s.On) || !l.menu(s.Meal) || !keep(id, s) {
+				continue
+			}
+
+			ss = append(ss, s)
+			rs = append(rs, row{id: id + "/" + s.Person, keys: map[string]string{
+				"on":     moment(s.On),
+				"person": s.Person,
+				"tavern": s.Tavern,
+				"meal":   s.Meal,
+			}})
+		}
+	}
+
+	is, next, err := paginate(l, sorts, rs)
+	p := SubscriptionPage{Subscriptions: make([]Subscriptions, len(is)), Next: next}
+	for n, i := range is {
+		p.Subscriptions[n] = ss[i]
+	}
+
+	return p, err
+}
+
+type RecordPage struct {
+	Records []Record
+	Next    string
+}
+
+// ListRecords of audit filtered by event name and time when event was
+// stored. Sort keys are at (default) and event.
+func (q *Query) ListRecords(l List) (RecordPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.listRecords(l, func(Record) bool { return true })
+}
+
+// listRecords pages records which pass filter of l and which keep tells
+// to keep.
+func (q *Query) listRecords(l List, keep func(Record) bool) (RecordPage, error) {
+	var records []Record
+	var rs []row
+	for _, r := range q.records {
+		if !l.name(r.Event) || !l.on(r.At) || !keep(r) {
+			continue
+		}
+
+		r.Metadata = metadata(r.Metadata)
+		records = append(records, r)
+		rs = append(rs, row{id: r.TavernUUID + "/" + number(int(r.Version)), keys: map[string]string{
+			"at":    moment(r.At),
+			"event": r.Event,
+		}})
+	}
+
+	is, next, err := paginate(l, []string{"at", "event"}, rs)
+	p := RecordPage{Records: make([]Record, len(is)), Next: next}
+	for n, i := range is {
+		p.Records[n] = records[i]
+	}
+
+	return p, err
+}
+
+type MealPage struct {
+	Meals []Meal
+	Next  string
+}
+
+// ListMeals filtered by name of person or tavern, scheduled time and
+// meal. Sort keys are on (default), tavern and meal, canceled lunches are
+// skipped.
+func (h *History) ListMeals(l List) (MealPage, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.listMeals(l, func(Meal) bool { return true })
+}
+
+// listMeals pages meals which pass filter of l and which keep tells to
+// keep, canceled lunches are skipped.
+func (h *History) listMeals(l List, keep func(Meal) bool) (MealPage, error) {
+	var ms []Meal
+	var rs []row
+	for _, pm := range h.meals {
+		for id, m := range pm {
+			if h.lunches[id].canceled || !l.name(m.Person, m.Tavern) || !l.on(m.On) || !l.menu(m.Meal) || !keep(m) {
+				continue
+			}
+
+			ms = append(ms, m)
+			rs = append(rs, row{id: id + "/" + m.Person, keys: map[string]string{
+				"on":     moment(m.On),
+				"tavern": m.Tavern,
+				"meal":   m.Meal,
+			}})
+		}
+	}
+
+	is, next, err := paginate(l, []string{"on", "tavern", "meal"}, rs)
+	p := MealPage{Meals: make([]Meal, len(is)), Next: next}
+	for n, i := range is {
+		p.Meals[n] = ms[i]
+	}
+
+	return p, err
+}
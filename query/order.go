@@ -0,0 +1,81 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Order is what is ordered in tavern, choices of people are summed up by
+// meal, so it can be read to the restaurant over the phone.
+type Order struct {
+	Tavern string    `json:"tavern"`
+	On     time.Time `json:"on"`
+	Lines  []Line    `json:"lines"`
+}
+
+// Line of order, people are ordered by name.
+type Line struct {
+	Meal   string   `json:"meal"`
+	Count  int      `json:"count"`
+	People []string `json:"people"`
+}
+
+// String renders order as plain text, ie.
+//
+//	PasiBus, Fri 30 Oct 2026 12:00
+//	3x Eggy: Cindy, Greg, Tom
+//	1x Gonzo: Joanna
+func (o Order) String() string {
+	var b strings.Builder
+	b.WriteString(o.Tavern)
+	if !o.On.IsZero() {
+		b.WriteString(o.On.Format(", Mon 2 Jan 2006 15:04"))
+	}
+	b.WriteString("\n")
+
+	for _, l := range o.Lines {
+		fmt.Fprintf(&b, "%dx %s: %s\n", l.Count, l.Meal, strings.Join(l.People, ", "))
+	}
+
+	return b.String()
+}
+
+// OrderSummary of tavern with given UUID, lines with most meals go first.
+func (q *Query) OrderSummary(tavern string) (Order, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	t, ok := q.taverns[tavern]
+	if !ok {
+		return Order{}, fmt.Errorf("tavern %s not found", tavern)
+	}
+
+	o := Order{Tavern: t.Name, On: t.On, Lines: []Line{}}
+	lines := map[string]int{}
+	for _, s := range q.subscriptions[tavern] {
+		i, ok := lines[s.Meal]
+		if !ok {
+			i, lines[s.Meal] = len(o.Lines), len(o.Lines)
+			o.Lines = append(o.Lines, Line{Meal: s.Meal})
+		}
+
+		o.Lines[i].Count++
+		o.Lines[i].People = append(o.Lines[i].People, s.Person)
+	}
+
+	for _, l := range o.Lines {
+		sort.Strings(l.People)
+	}
+
+	sort.Slice(o.Lines, func(i, j int) bool {
+		if o.Lines[i].Count != o.Lines[j].Count {
+			return o.Lines[i].Count > o.Lines[j].Count
+		}
+
+		return o.Lines[i].Meal < o.Lines[j].Meal
+	})
+
+	return o, nil
+}
@@ -1,8 +1,14 @@
 package query
 
 import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
 	"github.com/sokool/cqrsexample/events"
-	"github.com/sokool/gokit/cqrs"
+	"github.com/sokool/cqrsexample/shred"
 )
 
 type Tavern struct {
@@ -11,6 +17,11 @@ type Tavern struct {
 	Name string
 	Info string
 	Menu []string
+	On   time.Time // scheduled, zero until tavern is scheduled
+
+	Canceled bool
+	Sequence int       // number of times tavern was rescheduled
+	Updated  time.Time // when last event of tavern was stored
 }
 
 type Person struct {
@@ -18,59 +29,297 @@ type Person struct {
 	Name string
 }
 
+// Subscriptions tells what person eats in tavern and when.
 type Subscriptions struct {
 	PersonID int
 	TavernID int
+	Person   string
+	Tavern   string
+	Meal     string
+	On       time.Time
 }
 
+// Record is an audit entry of single stored event.
+type Record struct {
+	TavernUUID string
+	Event      string
+	Version    uint64
+	At         time.Time
+	Metadata   cqrs.Metadata
+}
+
+// Query is safe for concurrent use, it returns copies of its state, so
+// callers can not change it.
 type Query struct {
+	mu      sync.RWMutex
 	tid     int
 	pid     int
 	taverns map[string]Tavern
 	people  map[string]Person
+	records []Record
+
+	// tavern UUID -> key of tavern in Taverns
+	keys map[string]string
+
+	// tavern UUID -> person -> subscription
+	subscriptions map[string]map[string]Subscriptions
+
+	index    *index
+	watchers map[*watcher]bool
+
+	// position of last applied event in global log.
+	position uint64
 }
 
 func (q *Query) Listen(a cqrs.CQRSAggregate, ce []cqrs.Event, es []interface{}) {
-	for _, event := range es {
+	q.ListenContext(context.Background(), a, ce, es)
+}
+
+// ListenContext projects events with context of the command which produced
+// them. Events are already stored at this point, so they are applied even
+// when ctx is done, otherwise read model would miss them.
+func (q *Query) ListenContext(ctx context.Context, a cqrs.CQRSAggregate, ce []cqrs.Event, es []interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, e := range ce {
+		if e.Position > q.position {
+			q.position = e.Position
+		}
+
+		q.records = append(q.records, Record{
+			TavernUUID: a.ID,
+			Event:      e.Type,
+			Version:    e.Version,
+			At:         e.Created,
+			Metadata:   e.Metadata,
+		})
+	}
+
+	for i, event := range es {
 		switch e := event.(type) {
 		case *events.Created:
-			if _, ok := q.taverns[a.String()]; ok {
+			if _, ok := q.taverns[a.ID]; ok {
 				break
 			}
 
-			q.taverns[a.String()] = Tavern{
+			q.taverns[a.ID] = Tavern{
 				ID:   q.tid,
 				UUID: a.ID,
 				Name: e.Restaurant,
 				Info: e.Info,
-				Menu: e.Menu,
+				Menu: append([]string(nil), e.Menu...),
 			}
+			q.keys[a.ID] = a.String()
 			q.tid++
-		case *events.MealSelected:
-			if _, ok := q.people[e.Person]; ok {
-				break
-			}
 
-			q.people[e.Person] = Person{
-				ID:   q.pid,
-				Name: e.Person,
+			q.index.add(a.ID, e.Restaurant, nameWeight)
+			q.index.add(a.ID, e.Info, infoWeight)
+			q.index.add(a.ID, strings.Join(e.Menu, " "), menuWeight)
+		case *events.Scheduled:
+			q.schedule(a.ID, e.On)
+		case *events.Rescheduled:
+			q.schedule(a.ID, e.On)
+			if t, ok := q.taverns[a.ID]; ok {
+				t.Sequence++
+				q.taverns[a.ID] = t
+			}
+		case *events.Canceled:
+			if t, ok := q.taverns[a.ID]; ok {
+				t.Canceled = true
+				q.taverns[a.ID] = t
 			}
-			q.pid++
+		case *events.MealSelected:
+			q.subscribe(a.ID, e.Person, e.Meal)
+		case *events.MealChanged:
+			q.subscribe(a.ID, e.Person, e.NewMeal)
+		}
+
+		if i < len(ce) {
+			q.change(a.ID, ce[i].Position, event)
 		}
 	}
+
+	if t, ok := q.taverns[a.ID]; ok && len(ce) > 0 {
+		t.Updated = ce[len(ce)-1].Created
+		q.taverns[a.ID] = t
+	}
 }
 
+func (q *Query) schedule(tavern string, on time.Time) {
+	t, ok := q.taverns[tavern]
+	if !ok {
+		return
+	}
+
+	t.On = on
+	q.taverns[tavern] = t
+
+	for p, s := range q.subscriptions[tavern] {
+		s.On = on
+		q.subscriptions[tavern][p] = s
+	}
+}
+
+func (q *Query) subscribe(tavern, person, meal string) {
+	t, ok := q.taverns[tavern]
+	if !ok || shred.IsForgotten(person) {
+		return
+	}
+
+	p, ok := q.people[person]
+	if !ok {
+		p = Person{ID: q.pid, Name: person}
+		q.people[person] = p
+		q.pid++
+	}
+
+	if q.subscriptions[tavern] == nil {
+		q.subscriptions[tavern] = map[string]Subscriptions{}
+	}
+
+	q.subscriptions[tavern][person] = Subscriptions{
+		PersonID: p.ID,
+		TavernID: t.ID,
+		Person:   p.Name,
+		Tavern:   t.Name,
+		Meal:     meal,
+		On:       t.On,
+	}
+}
+
+// Swap replaces state of q with state of n, n must not be used anymore.
+func (q *Query) Swap(n *Query) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.tid, q.pid, q.position = n.tid, n.pid, n.position
+	q.taverns, q.people, q.records = n.taverns, n.people, n.records
+	q.keys = n.keys
+	q.subscriptions, q.index = n.subscriptions, n.index
+}
+
+// Position of last applied event in global log, with cqrs.Idempotent it
+// makes Query ignore events which are delivered again by subscription.
+func (q *Query) Position() uint64 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.position
+}
+
+// Taverns keyed as they always were, by description of restaurant
+// aggregate when it was created, use Tavern.UUID for its identifier.
 func (q *Query) Taverns() map[string]Tavern {
-	return q.taverns
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	ts := make(map[string]Tavern, len(q.taverns))
+	for id, t := range q.taverns {
+		t.Menu = append([]string(nil), t.Menu...)
+		ts[q.keys[id]] = t
+	}
+
+	return ts
 }
 
 func (q *Query) People() map[string]Person {
-	return q.people
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	ps := make(map[string]Person, len(q.people))
+	for k, p := range q.people {
+		ps[k] = p
+	}
+
+	return ps
+}
+
+// Eating returns what person eats in taverns scheduled in time range of
+// l, To is open ended when zero, ie. what Tom is eating this week. They
+// are filtered as in ListSubscriptions, sort keys are on (default) and
+// tavern. Canceled taverns are skipped.
+func (q *Query) Eating(person string, l List) (SubscriptionPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.eating(person, l)
+}
+
+func (q *Query) eating(person string, l List) (SubscriptionPage, error) {
+	return q.listSubscriptions(l, []string{"on", "tavern"}, func(_ string, s Subscriptions) bool {
+		return s.Person == person
+	})
+}
+
+// Coming returns subscriptions of people who eat in tavern of given name
+// scheduled on same day as on, ie. who is coming to PasiBus on Friday. Day
+// is compared in location of on. They are filtered as in
+// ListSubscriptions, sort keys are person (default) and meal.
+func (q *Query) Coming(tavern string, on time.Time, l List) (SubscriptionPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	y, m, d := on.Date()
+	return q.listSubscriptions(l, []string{"person", "meal"}, func(id string, s Subscriptions) bool {
+		t := q.taverns[id]
+		ty, tm, td := t.On.In(on.Location()).Date()
+		return t.Name == tavern && !t.On.IsZero() && ty == y && tm == m && td == d
+	})
+}
+
+// Forget removes person from read model, audit records where person was
+// an actor are kept, but actor becomes as, value person is loaded as since
+// shred.Forget.
+func (q *Query) Forget(person, as string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.people, person)
+	for _, ss := range q.subscriptions {
+		delete(ss, person)
+	}
+
+	for i, r := range q.records {
+		if r.Metadata[cqrs.Actor] != person {
+			continue
+		}
+
+		m := metadata(r.Metadata)
+		m[cqrs.Actor] = as
+		q.records[i].Metadata = m
+	}
+}
+
+// Audit returns records of events which metadata key has given value,
+// ie. Audit(cqrs.Actor, "tom", List{}) lists everything Tom did. Records
+// are filtered and sorted as in ListRecords.
+func (q *Query) Audit(key, value string, l List) (RecordPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.listRecords(l, func(r Record) bool { return r.Metadata[key] == value })
+}
+
+// metadata returns copy of m.
+func metadata(m cqrs.Metadata) cqrs.Metadata {
+	c := make(cqrs.Metadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
 }
 
 func New() *Query {
 	return &Query{
 		taverns: map[string]Tavern{},
 		people:  map[string]Person{},
+		keys:    map[string]string{},
+
+		subscriptions: map[string]map[string]Subscriptions{},
+		index:         newIndex(),
 	}
 }
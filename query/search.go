@@ -0,0 +1,112 @@
+package query
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Weights of tokens found in tavern fields, exact token weighs twice as
+// much as token which only starts with searched one.
+const (
+	nameWeight = 3
+	menuWeight = 2
+	infoWeight = 1
+)
+
+// index is inverted index of taverns, it maps tokens to weights of taverns
+// which contain them. Tokens are kept sorted as well, so tokens with given
+// prefix are found by binary search.
+type index struct {
+	tokens  map[string]map[string]int // token -> tavern UUID -> weight
+	ordered []string
+}
+
+func newIndex() *index {
+	return &index{tokens: map[string]map[string]int{}}
+}
+
+func (x *index) add(tavern, text string, weight int) {
+	for _, t := range tokenize(text) {
+		ts, ok := x.tokens[t]
+		if !ok {
+			ts = map[string]int{}
+			x.tokens[t] = ts
+
+			i := sort.SearchStrings(x.ordered, t)
+			x.ordered = append(x.ordered, "")
+			copy(x.ordered[i+1:], x.ordered[i:])
+			x.ordered[i] = t
+		}
+
+		ts[tavern] += weight
+	}
+}
+
+// scores of taverns which contain every token of text, or tokens starting
+// with them.
+func (x *index) scores(text string) map[string]int {
+	var ss map[string]int
+	for _, t := range tokenize(text) {
+		s := map[string]int{}
+		for i := sort.SearchStrings(x.ordered, t); i < len(x.ordered) && strings.HasPrefix(x.ordered[i], t); i++ {
+			n := 1
+			if x.ordered[i] == t {
+				n = 2
+			}
+
+			for tavern, w := range x.tokens[x.ordered[i]] {
+				s[tavern] += n * w
+			}
+		}
+
+		if ss != nil {
+			for tavern, w := range ss {
+				if _, ok := s[tavern]; !ok {
+					delete(ss, tavern)
+					continue
+				}
+				ss[tavern] = w + s[tavern]
+			}
+		} else {
+			ss = s
+		}
+	}
+
+	return ss
+}
+
+// polish letters with diacritics folded to ASCII ones.
+var polish = strings.NewReplacer(
+	"ą", "a", "ć", "c", "ę", "e", "ł", "l", "ń", "n",
+	"ó", "o", "ś", "s", "ź", "z", "ż", "z")
+
+// tokenize splits text into lower case words without diacritics.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(polish.Replace(strings.ToLower(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Search finds taverns which name, info or menu contain every word of
+// text, words are matched by their prefix and regardless of case and
+// Polish diacritics, ie. "ogor" finds "Ogórkowa". Taverns are filtered as
+// in ListTaverns, sort keys are score (default, most relevant first), name
+// and on.
+func (q *Query) Search(text string, l List) (TavernPage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	ss := q.index.scores(text)
+	return q.listTaverns(l, []string{"score", "name", "on"}, func(t Tavern) map[string]string {
+		s, ok := ss[t.UUID]
+		if !ok {
+			return nil
+		}
+
+		ks := tavernKeys(t)
+		ks["score"] = number(math.MaxInt32 - s)
+		return ks
+	})
+}
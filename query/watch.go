@@ -0,0 +1,171 @@
+package query
+
+import (
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/cqrsexample/shred"
+)
+
+type ChangeKind string
+
+const (
+	TavernCreated     ChangeKind = "tavern.created"
+	TavernScheduled   ChangeKind = "tavern.scheduled"
+	TavernRescheduled ChangeKind = "tavern.rescheduled"
+	TavernCanceled    ChangeKind = "tavern.canceled"
+	MealSelected      ChangeKind = "meal.selected"
+	MealChanged       ChangeKind = "meal.changed"
+)
+
+// Change of read model, Tavern is as it was right after the change. Person,
+// Meal and Previous meal are set for changes of meals only.
+type Change struct {
+	Kind     ChangeKind
+	Tavern   Tavern
+	Person   string
+	Meal     string
+	Previous string
+	Position uint64
+}
+
+// Backpressure tells what happens when watcher does not keep up with
+// changes and its buffer is full.
+type Backpressure int
+
+const (
+	// DropOldest change in buffer, to make room for new one.
+	DropOldest Backpressure = iota
+	// Disconnect watcher, its channel is closed.
+	Disconnect
+)
+
+type WatchOption func(*watcher)
+
+// Buffer of changes, default is 64. Buffer smaller than 1 is 1, as
+// DropOldest needs room for new change.
+func Buffer(n int) WatchOption {
+	return func(w *watcher) {
+		if n < 1 {
+			n = 1
+		}
+		w.buffer = n
+	}
+}
+
+// OnFull buffer of watcher apply given backpressure, default is DropOldest.
+func OnFull(b Backpressure) WatchOption {
+	return func(w *watcher) {
+		w.full = b
+	}
+}
+
+type watcher struct {
+	filter Filter
+	buffer int
+	full   Backpressure
+	ch     chan Change
+}
+
+// Watch returns channel of changes which match filter by name of tavern or
+// person, scheduled time of tavern and meal (or menu, for changes of
+// tavern). Changes are sent in order they were applied, so changes of
+// every tavern come in order of its events. Cancel closes channel.
+//
+// Changes are sent while read model is updated, so watcher which does not
+// read them loses them according to OnFull option, instead of holding
+// back read model.
+func (q *Query) Watch(f Filter, os ...WatchOption) (<-chan Change, func()) {
+	w := &watcher{filter: f, buffer: 64, full: DropOldest}
+	for _, fn := range os {
+		fn(w)
+	}
+	w.ch = make(chan Change, w.buffer)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.watchers == nil {
+		q.watchers = map[*watcher]bool{}
+	}
+	q.watchers[w] = true
+
+	return w.ch, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		q.unwatch(w)
+	}
+}
+
+func (q *Query) unwatch(w *watcher) {
+	if q.watchers[w] {
+		delete(q.watchers, w)
+		close(w.ch)
+	}
+}
+
+// change sends change made by event of tavern to watchers, q.mu is locked.
+func (q *Query) change(tavern string, position uint64, event interface{}) {
+	if len(q.watchers) == 0 {
+		return
+	}
+
+	t, ok := q.taverns[tavern]
+	if !ok {
+		return
+	}
+	t.Menu = append([]string(nil), t.Menu...)
+
+	c := Change{Tavern: t, Position: position}
+	switch e := event.(type) {
+	case *events.Created:
+		c.Kind = TavernCreated
+	case *events.Scheduled:
+		c.Kind = TavernScheduled
+	case *events.Rescheduled:
+		c.Kind = TavernRescheduled
+	case *events.Canceled:
+		c.Kind = TavernCanceled
+	case *events.MealSelected:
+		c.Kind, c.Person, c.Meal = MealSelected, e.Person, e.Meal
+	case *events.MealChanged:
+		c.Kind, c.Person, c.Meal, c.Previous = MealChanged, e.Person, e.NewMeal, e.PreviousMeal
+	default:
+		return
+	}
+
+	if shred.IsForgotten(c.Person) {
+		return
+	}
+
+	for w := range q.watchers {
+		f := w.filter
+		if !f.name(t.Name, c.Person) || !f.on(t.On) {
+			continue
+		}
+		if c.Person != "" && !f.menu(c.Meal) || c.Person == "" && !f.menu(t.Menu...) {
+			continue
+		}
+
+		q.send(w, c)
+	}
+}
+
+func (q *Query) send(w *watcher, c Change) {
+	for {
+		select {
+		case w.ch <- c:
+			return
+		default:
+		}
+
+		if w.full == Disconnect {
+			q.unwatch(w)
+			return
+		}
+
+		select {
+		case <-w.ch:
+		default:
+		}
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/sokool/cqrsexample/cqrs"
 	"github.com/sokool/cqrsexample/events"
-	"github.com/sokool/gokit/cqrs"
 )
 
 type aggregate struct {
@@ -20,7 +20,7 @@ type aggregate struct {
 
 	created   time.Time
 	scheduled time.Time
-	//canceled  time.Time
+	canceled  time.Time
 }
 
 type choice struct {
@@ -49,6 +49,10 @@ func (a *aggregate) Schedule(date time.Time) error {
 		return fmt.Errorf("restaurant not created yet")
 	}
 
+	if !a.canceled.IsZero() {
+		return fmt.Errorf("restaurant %s is canceled", a.name)
+	}
+
 	if !date.After(time.Now()) {
 		return fmt.Errorf("restaurant %s can not be scheduled in past", a.name)
 	}
@@ -76,6 +80,10 @@ func (a *aggregate) ChooseMeal(person, meal string) error {
 		return fmt.Errorf("restaurant is not scheduled yet")
 	}
 
+	if !a.canceled.IsZero() {
+		return fmt.Errorf("restaurant %s is canceled", a.name)
+	}
+
 	if s, ok := a.choices[person]; ok {
 		a.root.Apply(&events.MealChanged{
 			Person:       person,
@@ -94,6 +102,28 @@ func (a *aggregate) ChooseMeal(person, meal string) error {
 	return nil
 }
 
+// Cancel lunch in restaurant, it can not be scheduled nor chosen anymore.
+func (a *aggregate) Cancel(reason string) error {
+	if a.created.IsZero() {
+		return fmt.Errorf("restaurant is not created yet")
+	}
+
+	if !a.canceled.IsZero() {
+		return fmt.Errorf("restaurant %s is already canceled", a.name)
+	}
+
+	a.root.Apply(&events.Canceled{
+		Reason: reason,
+		At:     time.Now()})
+
+	return nil
+}
+
+// Meal tells what person has chosen, empty when person did not choose yet.
+func (a *aggregate) Meal(person string) string {
+	return a.choices[person].meal
+}
+
 func handler(a *aggregate) cqrs.DataHandler {
 	return func(e interface{}) error {
 		switch e := e.(type) {
@@ -122,6 +152,9 @@ func handler(a *aggregate) cqrs.DataHandler {
 		case *events.Rescheduled:
 			a.scheduled = e.On
 
+		case *events.Canceled:
+			a.canceled = e.At
+
 		default:
 			return fmt.Errorf("event %s not handled", reflect.TypeOf(e))
 		}
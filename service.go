@@ -1,31 +1,150 @@
 package cqrsexample
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/sokool/cqrsexample/cqrs"
 	"github.com/sokool/cqrsexample/events"
 	"github.com/sokool/cqrsexample/query"
-	"github.com/sokool/gokit/cqrs"
+	"github.com/sokool/cqrsexample/shred"
+)
+
+// Restaurants are snapshotted when they got snapshotEvery new events since
+// last snapshot, store is checked for them every snapshotFrequency.
+var (
+	snapshotEvery     uint = 20
+	snapshotFrequency      = time.Minute
 )
 
 type Service struct {
 	Query      *query.Query
+	History    *query.History
 	Restaurant *Restaurant
+
+	people shred.Keys
+
+	// projection is held by rebuild, while it swaps projection. Events at
+	// or before rebuilt position of projection are already in it.
+	projection sync.RWMutex
+	rebuilt    map[string]uint64
+
+	// async updates projections, when they are asynchronous.
+	async *cqrs.Async
+
+	// stop snapshotter of restaurants.
+	stop        context.CancelFunc
+	snapshotter *cqrs.Snapshotter
+}
+
+// NewService builds restaurant service, names of people are encrypted in
+// stored events and snapshots with keys given by People option.
+func NewService(os ...Option) *Service {
+	o := newOptions(os...)
+	s := &Service{
+		Query:   query.New(),
+		History: query.NewHistory(),
+		people:  o.people,
+		rebuilt: map[string]uint64{},
+	}
+	listen := cqrs.EventContextHandler(s.listen)
+	if o.async != nil {
+		s.async = cqrs.NewAsync(s.listen, o.async...)
+		listen = cqrs.AsyncHandler(s.async)
+	}
+
+	s.Restaurant = &Restaurant{
+		newRepository(append(o.repository,
+			listen,
+			shred.Protect(o.people))...),
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	s.stop = stop
+	s.snapshotter = s.Restaurant.repository.Snapshotter(ctx, snapshotEvery, snapshotFrequency)
+
+	return s
+}
+
+// listen applies saved events to projections, unless they are already
+// there.
+func (s *Service) listen(ctx context.Context, a cqrs.CQRSAggregate, ce []cqrs.Event, es []interface{}) {
+	s.projection.RLock()
+	defer s.projection.RUnlock()
+
+	for name, h := range map[string]cqrs.ContextHandlerFunc{
+		QueryProjection:   s.Query.ListenContext,
+		HistoryProjection: s.History.ListenContext,
+	} {
+		for i, e := range ce {
+			if e.Position > s.rebuilt[name] {
+				h(ctx, a, ce[i:], es[i:])
+				break
+			}
+		}
+	}
 }
 
-func NewService() *Service {
-	read := query.New()
-	write := &Restaurant{
-		cqrs.NewRepository(
-			factory,
-			events.All,
-			cqrs.EventHandler(read.Listen)),
+// WaitFor blocks until asynchronous projections got every event at and
+// before position, ie. after Save caller waits for position of restaurant
+// Root to read its own writes. Synchronous projections are always up to
+// date.
+func (s *Service) WaitFor(ctx context.Context, position uint64) error {
+	if s.async == nil {
+		return nil
 	}
 
-	return &Service{
-		Query:      read,
-		Restaurant: write,
+	return s.async.WaitFor(ctx, position)
+}
+
+// ProjectionLag tells how far behind saved events asynchronous projections
+// are, it is zero for synchronous ones.
+func (s *Service) ProjectionLag() cqrs.AsyncStats {
+	if s.async == nil {
+		return cqrs.AsyncStats{}
 	}
+
+	return s.async.Stats()
+}
+
+// Close stops snapshotter of restaurants and workers of asynchronous
+// projections, once they handled queued events.
+func (s *Service) Close() {
+	s.stop()
+	<-s.snapshotter.Done()
+
+	if s.async != nil {
+		s.async.Close()
+	}
+}
+
+// Subscribe h to restaurant events under given name, subscription replays
+// stored events from checkpoint kept in c and then follows new ones, until
+// its Run is stopped.
+func (s *Service) Subscribe(name string, h cqrs.ContextHandlerFunc, c cqrs.Checkpoints, os ...cqrs.SubscriptionOption) *cqrs.Subscription {
+	return s.Restaurant.repository.Subscribe(name, h, c, os...)
+}
+
+// Redeliver events of dead letter to h, see cqrs.Retry.
+func (s *Service) Redeliver(ctx context.Context, d cqrs.DeadLetters, id string, h cqrs.ErrorHandlerFunc) error {
+	return s.Restaurant.repository.Redeliver(ctx, d, id, h)
+}
+
+// ForgetPerson destroys key which protects person's name in stored events,
+// person is removed from projections and from now on is loaded as returned
+// value, which is unique for every forgotten person, see shred.IsForgotten.
+func (s *Service) ForgetPerson(person string) (string, error) {
+	as, err := shred.Forget(s.people, person)
+	if err != nil {
+		return "", err
+	}
+
+	s.Query.Forget(person, as)
+	s.History.Forget(person)
+
+	return as, nil
 }
 
 type Restaurant struct {
@@ -37,7 +156,56 @@ func (s *Restaurant) New() *aggregate {
 }
 
 func (s *Restaurant) Load(id string) (*aggregate, error) {
-	a, err := s.repository.Load(id)
+	return s.LoadContext(context.Background(), id)
+}
+
+// LoadContext rebuilds restaurant from its events, loading is aborted when
+// ctx is canceled or its deadline is exceeded.
+func (s *Restaurant) LoadContext(ctx context.Context, id string) (*aggregate, error) {
+	return restaurant(s.repository.LoadContext(ctx, id))
+}
+
+// LoadAt rebuilds restaurant as it was in given version. Returned
+// restaurant is read only, it can not be saved.
+func (s *Restaurant) LoadAt(id string, version uint64) (*aggregate, error) {
+	return s.LoadAtContext(context.Background(), id, version)
+}
+
+func (s *Restaurant) LoadAtContext(ctx context.Context, id string, version uint64) (*aggregate, error) {
+	return restaurant(s.repository.LoadAtContext(ctx, id, version))
+}
+
+// LoadAsOf rebuilds restaurant as it was at given time. Returned
+// restaurant is read only, it can not be saved.
+func (s *Restaurant) LoadAsOf(id string, at time.Time) (*aggregate, error) {
+	return s.LoadAsOfContext(context.Background(), id, at)
+}
+
+func (s *Restaurant) LoadAsOfContext(ctx context.Context, id string, at time.Time) (*aggregate, error) {
+	return restaurant(s.repository.LoadAsOfContext(ctx, id, at))
+}
+
+func (s *Restaurant) Save(a *aggregate) error {
+	return s.SaveContext(context.Background(), a)
+}
+
+// SaveContext stores restaurant events, ctx is handed over to the store
+// and to every listener, ie. query.Query.ListenContext.
+func (s *Restaurant) SaveContext(ctx context.Context, a *aggregate) error {
+	return s.repository.SaveContext(ctx, a)
+}
+
+func newRepository(os ...cqrs.Option) *cqrs.Repository {
+	os = append(os,
+		cqrs.Upcast(events.MealChangedName, 1, events.UpcastMealChangedV1))
+	for legacy, name := range events.Aliases {
+		os = append(os, cqrs.Alias(legacy, name))
+	}
+
+	return cqrs.NewRepository(factory, events.All, os...)
+}
+
+func restaurant(a cqrs.Aggregate, err error) (*aggregate, error) {
 	if err != nil {
 		return nil, err
 	}
@@ -50,10 +218,6 @@ func (s *Restaurant) Load(id string) (*aggregate, error) {
 	return r, nil
 }
 
-func (s *Restaurant) Save(a *aggregate) error {
-	return s.repository.Save(a)
-}
-
 func factory() (cqrs.Aggregate, cqrs.DataHandler) {
 	r := &aggregate{
 		choices: make(map[string]choice),
@@ -70,10 +234,77 @@ func (a *aggregate) Set(r *cqrs.Root) {
 	a.root = r
 }
 
+// snapshotVersion has to be increased whenever snapshot structure changes,
+// snapshots in other versions are ignored and restaurant is fully replayed.
+const snapshotVersion = 3
+
+type snapshot struct {
+	Version uint
+
+	Name    string
+	Info    string
+	Menu    []string
+	Choices []snapshotChoice
+
+	Created   time.Time
+	Scheduled time.Time
+	Canceled  time.Time
+}
+
+type snapshotChoice struct {
+	Person string `shred:"subject"`
+	Meal   string
+	On     time.Time
+}
+
 func (a *aggregate) TakeSnapshot() interface{} {
-	return nil
+	s := snapshot{
+		Version:   snapshotVersion,
+		Name:      a.name,
+		Info:      a.info,
+		Menu:      append([]string{}, a.menu...),
+		Choices:   make([]snapshotChoice, 0, len(a.choices)),
+		Created:   a.created,
+		Scheduled: a.scheduled,
+		Canceled:  a.canceled,
+	}
+
+	for _, c := range a.choices {
+		s.Choices = append(s.Choices, snapshotChoice{
+			Person: c.person,
+			Meal:   c.meal,
+			On:     c.on,
+		})
+	}
+	sort.Slice(s.Choices, func(i, j int) bool {
+		return s.Choices[i].Person < s.Choices[j].Person
+	})
+
+	return s
 }
 
-func (a *aggregate) RestoreSnapshot(s interface{}) error {
+func (a *aggregate) RestoreSnapshot(v interface{}) error {
+	s, ok := v.(*snapshot)
+	if !ok {
+		return fmt.Errorf("wrong snapshot type %T", v)
+	}
+
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d not supported, expects %d",
+			s.Version, snapshotVersion)
+	}
+
+	a.name, a.info = s.Name, s.Info
+	a.menu = append([]string{}, s.Menu...)
+	a.created, a.scheduled, a.canceled = s.Created, s.Scheduled, s.Canceled
+	a.choices = make(map[string]choice, len(s.Choices))
+	for _, c := range s.Choices {
+		a.choices[c.Person] = choice{
+			person: c.Person,
+			meal:   c.Meal,
+			on:     c.On,
+		}
+	}
+
 	return nil
 }
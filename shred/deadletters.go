@@ -0,0 +1,69 @@
+package shred
+
+import (
+	"context"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+type deadLetters struct {
+	cqrs.DeadLetters
+	codec *codec
+}
+
+// DeadLetters wraps d, so actor of events in dead letters is encrypted as
+// Store does with stored events, data of events is already encrypted by
+// Codec. Forgotten actor is loaded as forgotten value then.
+func DeadLetters(d cqrs.DeadLetters, k Keys) cqrs.DeadLetters {
+	return &deadLetters{DeadLetters: d, codec: &codec{keys: k}}
+}
+
+func (d *deadLetters) Put(ctx context.Context, l cqrs.DeadLetter) error {
+	es, err := d.actors(l.Events, d.codec.encrypt)
+	if err != nil {
+		return err
+	}
+	l.Events = es
+
+	return d.DeadLetters.Put(ctx, l)
+}
+
+func (d *deadLetters) List(ctx context.Context, handler string) ([]cqrs.DeadLetter, error) {
+	ls, err := d.DeadLetters.List(ctx, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ls {
+		if ls[i].Events, err = d.actors(ls[i].Events, d.codec.decrypt); err != nil {
+			return nil, err
+		}
+	}
+
+	return ls, nil
+}
+
+func (d *deadLetters) Get(ctx context.Context, id string) (cqrs.DeadLetter, error) {
+	l, err := d.DeadLetters.Get(ctx, id)
+	if err != nil {
+		return l, err
+	}
+
+	l.Events, err = d.actors(l.Events, d.codec.decrypt)
+
+	return l, err
+}
+
+// actors returns copy of es with actors transformed by fn.
+func (d *deadLetters) actors(es []cqrs.Event, fn func(string) (string, error)) ([]cqrs.Event, error) {
+	ts := make([]cqrs.Event, len(es))
+	for i, e := range es {
+		var err error
+		if e.Metadata, err = actor(e.Metadata, fn); err != nil {
+			return nil, err
+		}
+		ts[i] = e
+	}
+
+	return ts, nil
+}
@@ -0,0 +1,218 @@
+package shred
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type memory struct {
+	mu       sync.RWMutex
+	subjects map[string]string // subject -> key id
+	keys     map[string][]byte // key id -> key
+}
+
+// NewMemoryKeys keeps keys in memory, they are lost with the process.
+func NewMemoryKeys() Keys {
+	return &memory{
+		subjects: map[string]string{},
+		keys:     map[string][]byte{},
+	}
+}
+
+func (m *memory) Key(subject string) (string, []byte, error) {
+	m.mu.RLock()
+	id, ok := m.subjects[subject]
+	key := m.keys[id]
+	m.mu.RUnlock()
+	if ok {
+		return id, key, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, ok := m.subjects[subject]; ok {
+		return id, m.keys[id], nil
+	}
+
+	id, key, err := newKey()
+	if err != nil {
+		return "", nil, err
+	}
+	m.subjects[subject], m.keys[id] = id, key
+
+	return id, key, nil
+}
+
+// newKey generates 256 bit key with random id.
+func newKey() (string, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", nil, err
+	}
+
+	return uuid.New().String(), key, nil
+}
+
+func (m *memory) ByID(id string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, ErrForgotten
+	}
+
+	return key, nil
+}
+
+func (m *memory) Forget(subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, m.subjects[subject])
+	delete(m.subjects, subject)
+
+	return nil
+}
+
+// file keeps keys in memory and writes them to JSON file on every change,
+// keys in memory change only when file has been written.
+type file struct {
+	*memory
+	path string
+
+	// writing is held from copy of keys until file is renamed, so
+	// concurrent changes do not overwrite each other.
+	writing sync.Mutex
+}
+
+type keysFile struct {
+	Subjects map[string]string
+	Keys     map[string][]byte
+}
+
+// NewFileKeys keeps keys in JSON file at path, meant for local use. When
+// subject is forgotten file is rewritten without its key.
+func NewFileKeys(path string) (Keys, error) {
+	f := &file{memory: NewMemoryKeys().(*memory), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return f, nil
+	case err != nil:
+		return nil, err
+	}
+
+	var kf keysFile
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return nil, err
+	}
+
+	for s, id := range kf.Subjects {
+		f.subjects[s], f.keys[id] = id, kf.Keys[id]
+	}
+
+	return f, nil
+}
+
+func (f *file) Key(subject string) (string, []byte, error) {
+	f.mu.RLock()
+	id, ok := f.subjects[subject]
+	key := f.keys[id]
+	f.mu.RUnlock()
+	if ok {
+		return id, key, nil
+	}
+
+	f.writing.Lock()
+	defer f.writing.Unlock()
+
+	kf := f.copy()
+	if id, ok := kf.Subjects[subject]; ok {
+		return id, kf.Keys[id], nil
+	}
+
+	id, key, err := newKey()
+	if err != nil {
+		return "", nil, err
+	}
+	kf.Subjects[subject], kf.Keys[id] = id, key
+
+	if err := f.write(kf); err != nil {
+		return "", nil, err
+	}
+
+	f.mu.Lock()
+	f.subjects[subject], f.keys[id] = id, key
+	f.mu.Unlock()
+
+	return id, key, nil
+}
+
+func (f *file) Forget(subject string) error {
+	f.writing.Lock()
+	defer f.writing.Unlock()
+
+	kf := f.copy()
+	delete(kf.Keys, kf.Subjects[subject])
+	delete(kf.Subjects, subject)
+
+	if err := f.write(kf); err != nil {
+		return err
+	}
+
+	return f.memory.Forget(subject)
+}
+
+// copy of keys in memory.
+func (f *file) copy() keysFile {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	kf := keysFile{Subjects: map[string]string{}, Keys: map[string][]byte{}}
+	for s, id := range f.subjects {
+		kf.Subjects[s], kf.Keys[id] = id, f.keys[id]
+	}
+
+	return kf
+}
+
+// write replaces file atomically, keys are written to unique temporary
+// file first and then renamed.
+func (f *file) write(kf keysFile) error {
+	b, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+
+	t, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(t.Name())
+
+	if _, err := t.Write(b); err != nil {
+		t.Close()
+		return err
+	}
+
+	if err := t.Sync(); err != nil {
+		t.Close()
+		return err
+	}
+
+	if err := t.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(t.Name(), f.path)
+}
@@ -0,0 +1,346 @@
+// Package shred protects personal data stored in append only event log by
+// crypto-shredding. Struct fields tagged with `shred:"subject"` are
+// encrypted with key of their value (ie. person name) before they are
+// serialized. Once key of a subject is destroyed by Keys.Forget, subject
+// can not be decrypted anymore and is rendered as Forgotten followed by id
+// of destroyed key, so forgotten subjects stay distinct.
+package shred
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+// Forgotten prefixes value of subject which key has been destroyed, see
+// IsForgotten.
+const Forgotten = "forgotten"
+
+// IsForgotten tells if s is value of forgotten subject.
+func IsForgotten(s string) bool {
+	return s == Forgotten || strings.HasPrefix(s, Forgotten+":")
+}
+
+// forgotten is value of subject which key with given id has been destroyed.
+func forgotten(id string) string {
+	return Forgotten + ":" + id
+}
+
+// prefix of encrypted value, followed by key id and base64 of ciphertext.
+const prefix = "shred:"
+
+// Keys keeps encryption keys of subjects.
+type Keys interface {
+	// Key returns key of subject, key is created when subject has none.
+	Key(subject string) (id string, key []byte, err error)
+	// ByID returns key with given id, ErrForgotten when it is destroyed.
+	ByID(id string) ([]byte, error)
+	// Forget destroys key of subject.
+	Forget(subject string) error
+}
+
+// ErrForgotten is returned by Keys.ByID when key has been destroyed.
+var ErrForgotten = fmt.Errorf("shred: subject forgotten")
+
+// Forget destroys key of subject in k and returns value subject is loaded
+// as from now on.
+func Forget(k Keys, subject string) (string, error) {
+	id, _, err := k.Key(subject)
+	if err != nil {
+		return "", err
+	}
+
+	if err := k.Forget(subject); err != nil {
+		return "", err
+	}
+
+	return forgotten(id), nil
+}
+
+type codec struct {
+	cqrs.Codec
+	keys Keys
+}
+
+// Codec wraps c, so subject fields are encrypted before they are marshaled
+// by c and decrypted after they are unmarshaled. Codec has same name as c.
+func Codec(c cqrs.Codec, k Keys) cqrs.Codec {
+	return &codec{Codec: c, keys: k}
+}
+
+// Protect wraps every codec of repository with Codec and its storage with
+// Store, it has to be given after cqrs.Codecs and cqrs.Storage options.
+// Dead letters of handlers are not stored by repository, wrap them with
+// DeadLetters.
+func Protect(k Keys) cqrs.Option {
+	return func(o *cqrs.Options) {
+		if o.Storage == nil {
+			o.Storage = cqrs.NewMemoryStorage()
+		}
+		o.Storage = Store(o.Storage, k)
+
+		cs := map[string]cqrs.Codec{cqrs.JSON.Name(): Codec(cqrs.JSON, k)}
+		for n, c := range o.Codecs {
+			cs[n] = Codec(c, k)
+		}
+
+		if o.Codec == nil {
+			o.Codec = cqrs.JSON
+		}
+
+		o.Codec, o.Codecs = cs[o.Codec.Name()], cs
+	}
+}
+
+func (c *codec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if !subjects(rv.Type()) {
+		return c.Codec.Marshal(v)
+	}
+
+	// v is copied, so caller still sees plain values.
+	cp := reflect.New(rv.Type()).Elem()
+	cp.Set(rv)
+	cp = deepCopy(cp)
+
+	if err := walk(cp, c.encrypt); err != nil {
+		return nil, err
+	}
+
+	return c.Codec.Marshal(cp.Interface())
+}
+
+func (c *codec) Unmarshal(data []byte, v interface{}) error {
+	if err := c.Codec.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	return walk(reflect.ValueOf(v), c.decrypt)
+}
+
+func (c *codec) encrypt(s string) (string, error) {
+	if s == "" || IsForgotten(s) || strings.HasPrefix(s, prefix) {
+		return s, nil
+	}
+
+	id, key, err := c.keys.Key(s)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	b := gcm.Seal(nonce, nonce, []byte(s), []byte(id))
+
+	return prefix + id + ":" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decrypt returns s when it is not encrypted (stored before shredding was
+// enabled) and forgotten value when key of s is destroyed.
+func (c *codec) decrypt(s string) (string, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, nil
+	}
+
+	p := strings.SplitN(s[len(prefix):], ":", 2)
+	if len(p) != 2 {
+		return "", fmt.Errorf("shred: malformed value")
+	}
+
+	key, err := c.keys.ByID(p[0])
+	if err == ErrForgotten {
+		return forgotten(p[0]), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(p[1])
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return "", fmt.Errorf("shred: malformed value")
+	}
+
+	n := gcm.NonceSize()
+	o, err := gcm.Open(nil, b[:n], b[n:], []byte(p[0]))
+	if err != nil {
+		return "", err
+	}
+
+	return string(o), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(b)
+}
+
+// subjects tells if values of type t might contain subject fields.
+func subjects(t reflect.Type) bool {
+	return hasSubjects(t, map[reflect.Type]bool{})
+}
+
+func hasSubjects(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return hasSubjects(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Tag.Get("shred") == "subject" && f.Type.Kind() == reflect.String {
+				return true
+			}
+			if hasSubjects(f.Type, seen) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// walk replaces every subject field reachable from v with fn result.
+func walk(v reflect.Value, fn func(string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return walk(v.Elem(), fn)
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walk(v.Index(i), fn); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if !subjects(v.Type().Elem()) {
+			return nil
+		}
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err := walk(e, fn); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+
+			if f.Tag.Get("shred") == "subject" && f.Type.Kind() == reflect.String {
+				s, err := fn(v.Field(i).String())
+				if err != nil {
+					return fmt.Errorf("%s.%s: %s", t, f.Name, err)
+				}
+				v.Field(i).SetString(s)
+				continue
+			}
+
+			if err := walk(v.Field(i), fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deepCopy copies pointers, slices and maps of v which may lead to subject
+// fields, so encrypting the copy does not touch original value.
+func deepCopy(v reflect.Value) reflect.Value {
+	if !subjects(v.Type()) {
+		return v
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(deepCopy(v.Elem()))
+		return p
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return s
+
+	case reflect.Array:
+		a := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			a.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return a
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		m := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			m.SetMapIndex(k, deepCopy(v.MapIndex(k)))
+		}
+		return m
+
+	case reflect.Struct:
+		s := reflect.New(v.Type()).Elem()
+		s.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				s.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return s
+	}
+
+	return v
+}
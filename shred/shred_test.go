@@ -0,0 +1,107 @@
+package shred_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/shred"
+	"github.com/sokool/gokit/test/is"
+)
+
+type choice struct {
+	Person string `shred:"subject"`
+	Meal   string
+}
+
+type order struct {
+	Choices []choice
+	ByMeal  map[string]*choice
+}
+
+func TestCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shred")
+	is.NotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	keys, err := shred.NewFileKeys(filepath.Join(dir, "keys.json"))
+	is.NotErr(t, err)
+	c := shred.Codec(cqrs.JSON, keys)
+
+	//WHEN I marshal order with nested subjects
+	in := order{
+		Choices: []choice{{"Tom", "BBQ"}, {"Greg", "Eggy"}},
+		ByMeal:  map[string]*choice{"BBQ": {"Tom", "BBQ"}},
+	}
+	b, err := c.Marshal(in)
+	is.NotErr(t, err)
+
+	//I EXPECT subjects encrypted, but given value untouched
+	is.True(t, !bytes.Contains(b, []byte("Tom")), "plain text subject stored")
+	is.True(t, bytes.Contains(b, []byte("Eggy")), "meal expected in plain text")
+	is.Equal(t, "Tom", in.Choices[0].Person)
+	is.Equal(t, "Tom", in.ByMeal["BBQ"].Person)
+
+	//AND I EXPECT subjects decrypted, also with keys read from file again
+	keys, err = shred.NewFileKeys(filepath.Join(dir, "keys.json"))
+	is.NotErr(t, err)
+	var out order
+	is.NotErr(t, shred.Codec(cqrs.JSON, keys).Unmarshal(b, &out))
+	is.Equal(t, in, out)
+
+	//THEN Tom is forgotten
+	is.NotErr(t, keys.Forget("Tom"))
+
+	//I EXPECT Tom decoded as forgotten, Greg untouched
+	out = order{}
+	is.NotErr(t, shred.Codec(cqrs.JSON, keys).Unmarshal(b, &out))
+	is.True(t, shred.IsForgotten(out.Choices[0].Person), "Tom is not forgotten")
+	is.Equal(t, out.Choices[0].Person, out.ByMeal["BBQ"].Person)
+	is.Equal(t, "Greg", out.Choices[1].Person)
+
+	//AND I EXPECT plain values, stored before shredding, decoded as they are
+	out = order{}
+	is.NotErr(t, c.Unmarshal([]byte(`{"Choices":[{"Person":"Cindy"}]}`), &out))
+	is.Equal(t, "Cindy", out.Choices[0].Person)
+}
+
+func TestConcurrentFileKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shred")
+	is.NotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	keys, err := shred.NewFileKeys(filepath.Join(dir, "keys.json"))
+	is.NotErr(t, err)
+
+	//WHEN keys of many people are created concurrently
+	var wg sync.WaitGroup
+	ids, errs := make([]string, 32), make([]error, 32)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], _, errs[i] = keys.Key(fmt.Sprintf("person %d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	//I EXPECT every one of them kept in file
+	keys, err = shred.NewFileKeys(filepath.Join(dir, "keys.json"))
+	is.NotErr(t, err)
+	for i, id := range ids {
+		is.NotErr(t, errs[i])
+		k, _, err := keys.Key(fmt.Sprintf("person %d", i))
+		is.NotErr(t, err)
+		is.Equal(t, id, k)
+	}
+
+	//AND I EXPECT no temporary files left
+	fs, err := ioutil.ReadDir(dir)
+	is.NotErr(t, err)
+	is.Equal(t, 1, len(fs))
+}
@@ -0,0 +1,91 @@
+package shred
+
+import (
+	"context"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+type store struct {
+	cqrs.Store
+	codec *codec
+}
+
+// Store wraps s, so actor in metadata of saved events is encrypted with
+// its key, as subject fields are, and is loaded as forgotten value once
+// actor is forgotten.
+func Store(s cqrs.Store, k Keys) cqrs.Store {
+	return &store{Store: s, codec: &codec{keys: k}}
+}
+
+func (s *store) Save(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event) error {
+	ts := make([]cqrs.Event, len(es))
+	for i, e := range es {
+		var err error
+		if e.Metadata, err = actor(e.Metadata, s.codec.encrypt); err != nil {
+			return err
+		}
+		ts[i] = e
+	}
+
+	if err := s.Store.Save(ctx, a, ts); err != nil {
+		return err
+	}
+
+	for i := range ts {
+		es[i].Position = ts[i].Position
+	}
+
+	return nil
+}
+
+func (s *store) Events(ctx context.Context, version uint64, aggregate string) ([]cqrs.Event, error) {
+	es, err := s.Store.Events(ctx, version, aggregate)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range es {
+		if es[i].Metadata, err = actor(es[i].Metadata, s.codec.decrypt); err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
+
+func (s *store) ReadAll(ctx context.Context, position uint64, limit int, f cqrs.Filter) ([]cqrs.Record, error) {
+	rs, err := s.Store.ReadAll(ctx, position, limit, f)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rs {
+		if rs[i].Metadata, err = actor(rs[i].Metadata, s.codec.decrypt); err != nil {
+			return nil, err
+		}
+	}
+
+	return rs, nil
+}
+
+// actor returns copy of m with actor transformed by fn, m is not modified.
+func actor(m cqrs.Metadata, fn func(string) (string, error)) (cqrs.Metadata, error) {
+	a, ok := m[cqrs.Actor]
+	if !ok {
+		return m, nil
+	}
+
+	v, err := fn(a)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(cqrs.Metadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	c[cqrs.Actor] = v
+
+	return c, nil
+}
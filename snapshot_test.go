@@ -0,0 +1,150 @@
+package cqrsexample
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/cqrsexample/shred"
+	"github.com/sokool/gokit/test/is"
+)
+
+func TestSnapshotAndTailEqualsFullReplay(t *testing.T) {
+	//WHEN I have two repositories on same storage, one of them with snapshots
+	store := cqrs.NewMemoryStorage()
+	replay := cqrs.NewRepository(factory, events.All, cqrs.Storage(store))
+	snapshots := cqrs.NewRepository(factory, events.All, cqrs.Storage(store))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshotter := snapshots.Snapshotter(ctx, 5, time.Hour)
+
+	//THEN I create PasiBus, schedule it and let people change their minds
+	r := replay.Aggregate().(*aggregate)
+	is.NotErr(t, r.Create("PasiBus", "dobre burgery", "BBQ", "Eggy", "Gonzo"))
+	is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, r.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, r.ChooseMeal("Greg", "Eggy"))
+	is.NotErr(t, r.ChooseMeal("Tom", "Gonzo"))
+	is.NotErr(t, r.ChooseMeal("Tom", "Eggy"))
+	is.NotErr(t, replay.Save(r))
+
+	//AND I make a snapshot in version 6
+	snapshotter.Run()
+	v, _ := store.Snapshot(context.Background(), r.Root().ID)
+	is.Equal(t, uint64(6), v)
+
+	//THEN I add tail of 3 events after snapshot
+	is.NotErr(t, r.ChooseMeal("Cindy", "BBQ"))
+	is.NotErr(t, r.ChooseMeal("Greg", "Gonzo"))
+	is.NotErr(t, r.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, replay.Save(r))
+
+	//I EXPECT only tail is replayed when loading from snapshot
+	a, err := snapshots.Load(r.Root().ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(6), store.LastLoadVersion)
+	is.Equal(t, uint64(9), a.Root().Version)
+
+	//AND I EXPECT same state as full replay
+	b, err := replay.Load(r.Root().ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(0), store.LastLoadVersion)
+	is.Equal(t, uint64(9), b.Root().Version)
+	is.Equal(t, b.TakeSnapshot(), a.TakeSnapshot())
+
+	//AND I EXPECT restaurant loaded from snapshot can be changed and saved
+	is.NotErr(t, a.(*aggregate).ChooseMeal("Greg", "BBQ"))
+	is.NotErr(t, snapshots.Save(a))
+	is.Equal(t, uint64(10), a.Root().Version)
+}
+
+func TestSnapshotInUnknownVersionIsIgnored(t *testing.T) {
+	//WHEN I have restaurant with a snapshot in unsupported version
+	store := cqrs.NewMemoryStorage()
+	repo := cqrs.NewRepository(factory, events.All, cqrs.Storage(store))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repo.Snapshotter(ctx, 5, time.Hour)
+
+	r := repo.Aggregate().(*aggregate)
+	is.NotErr(t, r.Create("PasiBus", "dobre burgery", "BBQ", "Eggy"))
+	is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, r.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, repo.Save(r))
+	is.NotErr(t, store.Make(context.Background(), cqrs.Snapshot{
+		AggregateID: r.Root().ID,
+		Version:     3,
+		Data:        []byte(`{"Version":0,"Name":"Stale"}`),
+	}))
+
+	//THEN I load it
+	a, err := repo.Load(r.Root().ID)
+
+	//I EXPECT restaurant fully replayed from its events
+	is.NotErr(t, err)
+	is.Equal(t, uint64(0), store.LastLoadVersion)
+	is.Equal(t, uint64(3), a.Root().Version)
+	is.Equal(t, "PasiBus", a.(*aggregate).name)
+}
+
+func TestSnapshotIsShredded(t *testing.T) {
+	//WHEN I have snapshot of restaurant where Tom chose meal
+	store := cqrs.NewMemoryStorage()
+	keys := shred.NewMemoryKeys()
+	repo := newRepository(cqrs.Storage(store), shred.Protect(keys))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshotter := repo.Snapshotter(ctx, 1, time.Hour)
+
+	r := repo.Aggregate().(*aggregate)
+	is.NotErr(t, r.Create("PasiBus", "dobre burgery", "BBQ", "Eggy"))
+	is.NotErr(t, r.Schedule(time.Now().Add(24*time.Hour)))
+	is.NotErr(t, r.ChooseMeal("Tom", "BBQ"))
+	is.NotErr(t, repo.Save(r))
+	snapshotter.Run()
+
+	//I EXPECT no Tom in stored snapshot
+	v, data := store.Snapshot(context.Background(), r.Root().ID)
+	is.Equal(t, uint64(3), v)
+	is.True(t, !bytes.Contains(data, []byte("Tom")), "plain text person stored")
+
+	//THEN Tom is forgotten
+	tom, err := shred.Forget(keys, "Tom")
+	is.NotErr(t, err)
+
+	//I EXPECT restaurant loaded from snapshot without Tom
+	a, err := repo.Load(r.Root().ID)
+	is.NotErr(t, err)
+	is.Equal(t, uint64(3), store.LastLoadVersion)
+	is.Equal(t, "", a.(*aggregate).Meal("Tom"))
+	is.Equal(t, "BBQ", a.(*aggregate).Meal(tom))
+}
+
+func TestSnapshotterStops(t *testing.T) {
+	//WHEN snapshotter checks store very often
+	repo := cqrs.NewRepository(factory, events.All, cqrs.Storage(cqrs.NewMemoryStorage()))
+	ctx, cancel := context.WithCancel(context.Background())
+	snapshotter := repo.Snapshotter(ctx, 1, time.Millisecond)
+
+	//THEN its context is canceled
+	cancel()
+
+	//I EXPECT it stopped
+	select {
+	case <-snapshotter.Done():
+	case <-time.After(time.Second):
+		t.Fatal("snapshotter is still running")
+	}
+
+	//AND I EXPECT service stopped its snapshotter once it is closed
+	s := NewService()
+	s.Close()
+	select {
+	case <-s.snapshotter.Done():
+	default:
+		t.Fatal("snapshotter of service is still running")
+	}
+}
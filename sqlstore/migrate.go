@@ -0,0 +1,133 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Migrate applies migrations of dialect which are not applied yet, every
+// one of them in its own transaction. Applied versions are recorded in
+// schema_migrations table.
+func Migrate(db *sql.DB, d Dialect) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY
+	)`)
+	if err != nil {
+		return err
+	}
+
+	ms, err := load(d.Name)
+	if err != nil {
+		return err
+	}
+
+	applied := map[int]bool{}
+	rs, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rs.Next() {
+		var v int
+		if err := rs.Scan(&v); err != nil {
+			rs.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	if err := rs.Close(); err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if applied[m.version] {
+			continue
+		}
+
+		if err := apply(db, d, m); err != nil {
+			return fmt.Errorf("sqlstore: migration %s: %s", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func apply(db *sql.DB, d Dialect, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, s := range statements(m.sql) {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+
+	q := d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`)
+	if _, err := tx.Exec(q, m.version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// load returns migrations of dialect ordered by version, file name starts
+// with version, ie. 0001_events.sql.
+func load(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	fs, err := migrations.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("sqlstore: no migrations of %s dialect", dialect)
+	}
+
+	var ms []migration
+	for _, f := range fs {
+		if f.IsDir() || path.Ext(f.Name()) != ".sql" {
+			continue
+		}
+
+		v, err := strconv.Atoi(strings.SplitN(f.Name(), "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("sqlstore: %s has no version", f.Name())
+		}
+
+		b, err := migrations.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		ms = append(ms, migration{version: v, name: f.Name(), sql: string(b)})
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+
+	return ms, nil
+}
+
+// statements splits migration by semicolons, not every driver runs many
+// statements in one Exec.
+func statements(sql string) []string {
+	var ss []string
+	for _, s := range strings.Split(sql, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			ss = append(ss, s)
+		}
+	}
+
+	return ss
+}
@@ -0,0 +1,36 @@
+CREATE TABLE aggregates (
+	id      VARCHAR(64)  NOT NULL PRIMARY KEY,
+	type    VARCHAR(255) NOT NULL,
+	version BIGINT       NOT NULL
+);
+
+CREATE INDEX aggregates_type ON aggregates (type);
+
+CREATE TABLE events (
+	id           VARCHAR(64)  NOT NULL PRIMARY KEY,
+	aggregate_id VARCHAR(64)  NOT NULL REFERENCES aggregates (id),
+	version      BIGINT       NOT NULL,
+	type         VARCHAR(255) NOT NULL,
+	schema_version INTEGER    NOT NULL,
+	codec        VARCHAR(32)  NOT NULL,
+	data         BLOB         NOT NULL,
+	metadata     TEXT         NOT NULL,
+	created      VARCHAR(40)  NOT NULL,
+	position     BIGINT       NOT NULL,
+	UNIQUE (aggregate_id, version),
+	UNIQUE (position)
+);
+
+CREATE TABLE snapshots (
+	aggregate_id VARCHAR(64) NOT NULL PRIMARY KEY,
+	version      BIGINT      NOT NULL,
+	data         BLOB        NOT NULL
+);
+
+-- log keeps last global position, it is updated by every Save, so saves are
+-- serialized on its row and positions follow commit order.
+CREATE TABLE log (
+	position BIGINT NOT NULL
+);
+
+INSERT INTO log (position) VALUES (0);
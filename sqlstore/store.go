@@ -0,0 +1,361 @@
+// Package sqlstore is cqrs.Store kept in SQL database, it uses database/sql
+// only, so driver has to be registered by the caller. Embedded SQLite, with
+// pure Go driver, works without cgo and any external service, busy timeout
+// makes concurrent saves wait for each other instead of failing with
+// "database is locked":
+//
+//	import _ "modernc.org/sqlite"
+//
+//	db, err := sql.Open("sqlite", "file:lunch.db?_txlock=immediate"+
+//		"&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+//	s, err := sqlstore.Open(db, sqlstore.SQLite)
+//
+// Queries stick to standard SQL, differences between databases (ie. type of
+// binary column or placeholders) are kept in Dialect and its migrations,
+// which are embedded in binary.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/gokit/log"
+)
+
+// Dialect of SQL database, Name is directory of its migrations.
+type Dialect struct {
+	Name string
+	// Placeholder of n-th (counted from 1) query argument.
+	Placeholder func(n int) string
+}
+
+// SQLite dialect.
+var SQLite = Dialect{
+	Name:        "sqlite",
+	Placeholder: func(int) string { return "?" },
+}
+
+// rebind replaces ? in query with placeholders of dialect.
+func (d Dialect) rebind(q string) string {
+	if d.Placeholder == nil {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString(d.Placeholder(n))
+	}
+
+	return b.String()
+}
+
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// Open migrates db and returns store kept in it.
+func Open(db *sql.DB, d Dialect) (*Store, error) {
+	if err := Migrate(db, d); err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db, dialect: d}, nil
+}
+
+// Save aggregate and its events in one transaction. Version of aggregate is
+// compared and set in single statement and (aggregate_id, version) is unique
+// among events, so two concurrent saves of same version can not both
+// succeed, database rejects one of them.
+func (s *Store) Save(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	expected := a.Version - uint64(len(es))
+
+	// failed statement aborts transaction in some databases, so it is
+	// rolled back before stored version is checked.
+	fail := func(err error) error {
+		tx.Rollback()
+		return s.conflict(ctx, a, expected, err)
+	}
+
+	if err := s.version(ctx, tx, a, expected); err != nil {
+		return fail(err)
+	}
+
+	last, err := s.positions(ctx, tx, len(es))
+	if err != nil {
+		return err
+	}
+
+	ps := make([]uint64, len(es))
+	q := s.dialect.rebind(`INSERT INTO events
+		(id, aggregate_id, version, type, schema_version, codec, data, metadata, created, position)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	for i, e := range es {
+		m, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return err
+		}
+
+		ps[i] = last - uint64(len(es)) + uint64(i) + 1
+		_, err = tx.ExecContext(ctx, q,
+			e.ID, a.ID, e.Version, e.Type, e.Schema, e.Codec, e.Data, string(m),
+			e.Created.Format(time.RFC3339Nano), ps[i])
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	for i := range es {
+		es[i].Position = ps[i]
+	}
+
+	return nil
+}
+
+// positions reserves n global positions and returns last of them. Row of
+// log stays locked until transaction ends, so positions are given in order
+// of commits.
+func (s *Store) positions(ctx context.Context, tx *sql.Tx, n int) (uint64, error) {
+	q := s.dialect.rebind(`UPDATE log SET position = position + ?`)
+	if _, err := tx.ExecContext(ctx, q, n); err != nil {
+		return 0, err
+	}
+
+	var p uint64
+	err := tx.QueryRowContext(ctx, `SELECT position FROM log`).Scan(&p)
+
+	return p, err
+}
+
+// version moves aggregate from expected version to a.Version, aggregate
+// is created when expected version is 0.
+func (s *Store) version(ctx context.Context, tx *sql.Tx, a cqrs.CQRSAggregate, expected uint64) error {
+	if expected == 0 {
+		q := s.dialect.rebind(`INSERT INTO aggregates (id, type, version) VALUES (?, ?, ?)`)
+		_, err := tx.ExecContext(ctx, q, a.ID, a.Type, a.Version)
+
+		return err
+	}
+
+	q := s.dialect.rebind(`UPDATE aggregates SET version = ? WHERE id = ? AND version = ?`)
+	r, err := tx.ExecContext(ctx, q, a.Version, a.ID, expected)
+	if err != nil {
+		return err
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("aggregate %s not found", a.ID)
+	}
+
+	return nil
+}
+
+// conflict turns err into version missmatch when stored aggregate is not
+// in expected version, errors of constraints differ among drivers, so
+// stored version is checked instead.
+func (s *Store) conflict(ctx context.Context, a cqrs.CQRSAggregate, expected uint64, err error) error {
+	var v uint64
+	q := s.dialect.rebind(`SELECT version FROM aggregates WHERE id = ?`)
+	switch qerr := s.db.QueryRowContext(ctx, q, a.ID).Scan(&v); {
+	case qerr == nil && v != expected:
+	case qerr == sql.ErrNoRows && expected != 0:
+	default:
+		return err
+	}
+
+	return fmt.Errorf(
+		"%s version missmatch, arrived: %d, expects: %d",
+		a.Type, a.Version, v)
+}
+
+func (s *Store) Load(ctx context.Context, id string) (cqrs.CQRSAggregate, error) {
+	a := cqrs.CQRSAggregate{ID: id}
+	q := s.dialect.rebind(`SELECT type, version FROM aggregates WHERE id = ?`)
+	err := s.db.QueryRowContext(ctx, q, id).Scan(&a.Type, &a.Version)
+	if err == sql.ErrNoRows {
+		return cqrs.CQRSAggregate{}, fmt.Errorf("aggregate %s not found", id)
+	}
+	if err != nil {
+		return cqrs.CQRSAggregate{}, err
+	}
+
+	return a, nil
+}
+
+func (s *Store) Events(ctx context.Context, version uint64, id string) ([]cqrs.Event, error) {
+	q := s.dialect.rebind(`SELECT ` + columns + `
+		FROM events WHERE aggregate_id = ? AND version > ? ORDER BY version`)
+	rs, err := s.db.QueryContext(ctx, q, id, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var es []cqrs.Event
+	for rs.Next() {
+		var e cqrs.Event
+		if err := scan(rs, &e); err != nil {
+			return nil, err
+		}
+
+		es = append(es, e)
+	}
+
+	return es, rs.Err()
+}
+
+// ReadAll reads events joined with their aggregates, LIMIT is not standard
+// SQL, but every database we care about knows it.
+func (s *Store) ReadAll(ctx context.Context, position uint64, limit int, f cqrs.Filter) ([]cqrs.Record, error) {
+	q := `SELECT a.id, a.type, ` + columns + `
+		FROM events JOIN aggregates a ON a.id = events.aggregate_id
+		WHERE events.position > ?`
+	args := []interface{}{position}
+
+	in := func(column string, vs []string) {
+		if len(vs) == 0 {
+			return
+		}
+
+		q += ` AND ` + column + ` IN (?` + strings.Repeat(`, ?`, len(vs)-1) + `)`
+		for _, v := range vs {
+			args = append(args, v)
+		}
+	}
+	in(`events.type`, f.Events)
+	in(`a.type`, f.Aggregates)
+
+	q += ` ORDER BY events.position`
+	if limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rs, err := s.db.QueryContext(ctx, s.dialect.rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var o []cqrs.Record
+	for rs.Next() {
+		var r cqrs.Record
+		if err := scan(rs, &r.Event, &r.Aggregate.ID, &r.Aggregate.Type); err != nil {
+			return nil, err
+		}
+		r.Aggregate.Version = r.Version
+
+		o = append(o, r)
+	}
+
+	return o, rs.Err()
+}
+
+// columns of event read by scan.
+const columns = `events.id, events.version, events.type, events.schema_version,
+	events.codec, events.data, events.metadata, events.created, events.position`
+
+// scan columns of event, preceded by given columns.
+func scan(rs *sql.Rows, e *cqrs.Event, before ...interface{}) error {
+	var m, created string
+
+	err := rs.Scan(append(before, &e.ID, &e.Version, &e.Type, &e.Schema, &e.Codec,
+		&e.Data, &m, &created, &e.Position)...)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(m), &e.Metadata); err != nil {
+		return err
+	}
+
+	e.Created, err = time.Parse(time.RFC3339Nano, created)
+
+	return err
+}
+
+func (s *Store) Last(ctx context.Context, kind string, frequency uint) ([]cqrs.CQRSAggregate, error) {
+	q := s.dialect.rebind(`SELECT a.id, a.type, COALESCE(s.version, 0)
+		FROM aggregates a LEFT JOIN snapshots s ON s.aggregate_id = a.id
+		WHERE a.type = ? AND a.version - COALESCE(s.version, 0) >= ?`)
+	rs, err := s.db.QueryContext(ctx, q, kind, frequency)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var o []cqrs.CQRSAggregate
+	for rs.Next() {
+		var a cqrs.CQRSAggregate
+		if err := rs.Scan(&a.ID, &a.Type, &a.Version); err != nil {
+			return nil, err
+		}
+		o = append(o, a)
+	}
+
+	return o, rs.Err()
+}
+
+// Make replaces snapshot, delete and insert are used instead of upsert,
+// which syntax differs among databases.
+func (s *Store) Make(ctx context.Context, n cqrs.Snapshot) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := s.dialect.rebind(`DELETE FROM snapshots WHERE aggregate_id = ?`)
+	if _, err := tx.ExecContext(ctx, q, n.AggregateID); err != nil {
+		return err
+	}
+
+	q = s.dialect.rebind(`INSERT INTO snapshots (aggregate_id, version, data) VALUES (?, ?, ?)`)
+	if _, err := tx.ExecContext(ctx, q, n.AggregateID, n.Version, n.Data); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) Snapshot(ctx context.Context, id string) (uint64, []byte) {
+	var v uint64
+	var data []byte
+	q := s.dialect.rebind(`SELECT version, data FROM snapshots WHERE aggregate_id = ?`)
+	err := s.db.QueryRowContext(ctx, q, id).Scan(&v, &data)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error("sqlstore.snapshot", err)
+		}
+		return 0, []byte{}
+	}
+
+	return v, data
+}
@@ -0,0 +1,66 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/cqrs/storetest"
+	"github.com/sokool/gokit/test/is"
+	_ "modernc.org/sqlite"
+)
+
+// dsn of SQLite database file, as given in package documentation.
+const dsn = "file:%s?_txlock=immediate&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+
+func open(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "sqlstore")
+	is.NotErr(t, err)
+
+	db, err := sql.Open("sqlite", fmt.Sprintf(dsn, filepath.Join(dir, "lunch.db")))
+	is.NotErr(t, err)
+
+	s, err := Open(db, SQLite)
+	is.NotErr(t, err)
+
+	return s, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (cqrs.Store, func()) {
+		return open(t)
+	})
+}
+
+func TestMigrationsEmbedded(t *testing.T) {
+	//WHEN I load migrations of SQLite
+	ms, err := load(SQLite.Name)
+
+	//I EXPECT them ordered by version
+	is.NotErr(t, err)
+	is.True(t, len(ms) > 0, "migrations expected")
+	for i, m := range ms {
+		is.Equal(t, i+1, m.version)
+		is.True(t, len(statements(m.sql)) > 0, "statements expected")
+	}
+
+	//AND I EXPECT error for dialect without migrations
+	_, err = load("oracle")
+	is.Err(t, err, "no migrations")
+}
+
+func TestRebind(t *testing.T) {
+	postgres := Dialect{Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	q := `UPDATE aggregates SET version = ? WHERE id = ? AND version = ?`
+
+	is.Equal(t, q, SQLite.rebind(q))
+	is.Equal(t, `UPDATE aggregates SET version = $1 WHERE id = $2 AND version = $3`,
+		postgres.rebind(q))
+}
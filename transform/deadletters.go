@@ -0,0 +1,81 @@
+package transform
+
+import (
+	"context"
+
+	"github.com/sokool/cqrsexample/cqrs"
+)
+
+type deadLetters struct {
+	cqrs.DeadLetters
+	pipeline *pipeline
+}
+
+// NewDeadLetters wraps d, data of events in dead letters is transformed as
+// NewStore does with stored events, so give it the same options. Otherwise
+// events which failed in handler would be kept in plain text.
+//
+//	d, err := filestore.NewDeadLetters(dir)
+//	...
+//	cqrs.Retry("mailer", mailer, transform.NewDeadLetters(d,
+//		transform.Compress(transform.Gzip),
+//		transform.Encrypt(keys)))
+func NewDeadLetters(d cqrs.DeadLetters, os ...Option) cqrs.DeadLetters {
+	return &deadLetters{DeadLetters: d, pipeline: newPipeline(os...)}
+}
+
+func (d *deadLetters) Put(ctx context.Context, l cqrs.DeadLetter) error {
+	es := make([]cqrs.Event, len(l.Events))
+	for i, e := range l.Events {
+		data, err := d.pipeline.seal(e.Data, []byte(e.ID))
+		if err != nil {
+			return err
+		}
+
+		e.Data = data
+		es[i] = e
+	}
+	l.Events = es
+
+	return d.DeadLetters.Put(ctx, l)
+}
+
+func (d *deadLetters) List(ctx context.Context, handler string) ([]cqrs.DeadLetter, error) {
+	ls, err := d.DeadLetters.List(ctx, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ls {
+		if ls[i], err = d.open(ls[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return ls, nil
+}
+
+func (d *deadLetters) Get(ctx context.Context, id string) (cqrs.DeadLetter, error) {
+	l, err := d.DeadLetters.Get(ctx, id)
+	if err != nil {
+		return l, err
+	}
+
+	return d.open(l)
+}
+
+// open returns l with data of its events opened, events of d are not
+// modified, as they might be kept by wrapped dead letters.
+func (d *deadLetters) open(l cqrs.DeadLetter) (cqrs.DeadLetter, error) {
+	es := make([]cqrs.Event, len(l.Events))
+	for i, e := range l.Events {
+		var err error
+		if e.Data, err = d.pipeline.open(e.Data, []byte(e.ID)); err != nil {
+			return l, err
+		}
+		es[i] = e
+	}
+	l.Events = es
+
+	return l, nil
+}
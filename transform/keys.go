@@ -0,0 +1,114 @@
+package transform
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// FileKeys is KeyProvider which keeps keys in JSON file, meant for local
+// use and tests. File looks like:
+//
+//	{
+//	  "current": "2026-10",
+//	  "keys": {"2026-09": "<base64 key>", "2026-10": "<base64 key>"}
+//	}
+//
+// Keys are never removed on rotation, so older events are still readable.
+type FileKeys struct {
+	mu   sync.RWMutex
+	path string
+	file keysFile
+}
+
+type keysFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// NewFileKeys reads keys from path, when file does not exist it is created
+// with one fresh key.
+func NewFileKeys(path string) (*FileKeys, error) {
+	k := &FileKeys{path: path}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		k.file.Keys = map[string][]byte{}
+		return k, k.Rotate("1")
+	case err != nil:
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &k.file); err != nil {
+		return nil, fmt.Errorf("transform: %s: %s", path, err)
+	}
+
+	if _, ok := k.file.Keys[k.file.Current]; !ok {
+		return nil, fmt.Errorf("transform: %s: current key %s not found",
+			path, k.file.Current)
+	}
+
+	return k, nil
+}
+
+func (k *FileKeys) Current() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.file.Current, k.file.Keys[k.file.Current], nil
+}
+
+func (k *FileKeys) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.file.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("transform: key %s not found", id)
+	}
+
+	return key, nil
+}
+
+// Rotate generates new 256 bit key with given id, makes it current and
+// writes file. Keys in use change only when file has been written.
+func (k *FileKeys) Rotate(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.file.Keys[id]; ok {
+		return fmt.Errorf("transform: key %s already exists", id)
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	f := keysFile{Current: id, Keys: map[string][]byte{id: key}}
+	for i, key := range k.file.Keys {
+		f.Keys[i] = key
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := k.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, k.path); err != nil {
+		return err
+	}
+
+	k.file = f
+
+	return nil
+}
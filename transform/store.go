@@ -0,0 +1,103 @@
+package transform
+
+import (
+	"context"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/gokit/log"
+)
+
+type store struct {
+	cqrs.Store
+	pipeline *pipeline
+}
+
+// NewStore wraps s, data of saved events and snapshots is transformed by
+// given options before it reaches s. Without options data is untouched.
+//
+//	cqrs.Storage(transform.NewStore(s,
+//		transform.Compress(transform.Gzip),
+//		transform.Encrypt(keys)))
+func NewStore(s cqrs.Store, os ...Option) cqrs.Store {
+	return &store{Store: s, pipeline: newPipeline(os...)}
+}
+
+func (s *store) Save(ctx context.Context, a cqrs.CQRSAggregate, es []cqrs.Event) error {
+	ts := make([]cqrs.Event, len(es))
+	for i, e := range es {
+		data, err := s.pipeline.seal(e.Data, []byte(e.ID))
+		if err != nil {
+			return err
+		}
+
+		e.Data = data
+		ts[i] = e
+	}
+
+	if err := s.Store.Save(ctx, a, ts); err != nil {
+		return err
+	}
+
+	for i := range ts {
+		es[i].Position = ts[i].Position
+	}
+
+	return nil
+}
+
+func (s *store) Events(ctx context.Context, version uint64, aggregate string) ([]cqrs.Event, error) {
+	es, err := s.Store.Events(ctx, version, aggregate)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range es {
+		if es[i].Data, err = s.pipeline.open(es[i].Data, []byte(es[i].ID)); err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
+
+func (s *store) ReadAll(ctx context.Context, position uint64, limit int, f cqrs.Filter) ([]cqrs.Record, error) {
+	rs, err := s.Store.ReadAll(ctx, position, limit, f)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rs {
+		if rs[i].Data, err = s.pipeline.open(rs[i].Data, []byte(rs[i].ID)); err != nil {
+			return nil, err
+		}
+	}
+
+	return rs, nil
+}
+
+func (s *store) Make(ctx context.Context, n cqrs.Snapshot) error {
+	data, err := s.pipeline.seal(n.Data, []byte(n.AggregateID))
+	if err != nil {
+		return err
+	}
+
+	n.Data = data
+	return s.Store.Make(ctx, n)
+}
+
+// Snapshot which can not be opened is treated as missing one, aggregate
+// is rebuilt from its events then.
+func (s *store) Snapshot(ctx context.Context, aggregate string) (uint64, []byte) {
+	version, data := s.Store.Snapshot(ctx, aggregate)
+	if len(data) == 0 {
+		return version, data
+	}
+
+	data, err := s.pipeline.open(data, []byte(aggregate))
+	if err != nil {
+		log.Error("transform.snapshot.open", err)
+		return 0, []byte{}
+	}
+
+	return version, data
+}
@@ -0,0 +1,192 @@
+package transform_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/filestore"
+	"github.com/sokool/cqrsexample/transform"
+	"github.com/sokool/gokit/test/is"
+)
+
+const id = "7f1c2b7e-55aa-4c3e-9b1d-2f6a9d3c8e01"
+
+var ctx = context.Background()
+
+func event(version uint64, data string) cqrs.Event {
+	return cqrs.Event{
+		ID:      fmt.Sprintf("%s%012d", id[:24], version),
+		Type:    "restaurant.meal_selected",
+		Data:    []byte(data),
+		Version: version,
+	}
+}
+
+func keys(t *testing.T) (*transform.FileKeys, string) {
+	dir, err := ioutil.TempDir("", "keys")
+	is.NotErr(t, err)
+
+	k, err := transform.NewFileKeys(filepath.Join(dir, "keys.json"))
+	is.NotErr(t, err)
+
+	return k, dir
+}
+
+func TestCompressAndEncrypt(t *testing.T) {
+	k, dir := keys(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I save event through compressing and encrypting store
+	mem := cqrs.NewMemoryStorage()
+	s := transform.NewStore(mem,
+		transform.Compress(transform.Gzip),
+		transform.Encrypt(k))
+	data := `{"Person":"Tom","Meal":"Pierogi"}`
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: id, Version: 1},
+		[]cqrs.Event{event(1, data)}))
+
+	//I EXPECT no person in stored data
+	raw, err := mem.Events(ctx, 0, id)
+	is.NotErr(t, err)
+	is.True(t, !bytes.Contains(raw[0].Data, []byte("Tom")), "plain text stored")
+
+	//AND I EXPECT original data when loaded
+	es, err := s.Events(ctx, 0, id)
+	is.NotErr(t, err)
+	is.Equal(t, data, string(es[0].Data))
+
+	//THEN I copy encrypted data to another event
+	is.NotErr(t, mem.Save(ctx, cqrs.CQRSAggregate{ID: id, Version: 2},
+		[]cqrs.Event{{ID: event(2, "").ID, Data: raw[0].Data, Version: 2}}))
+
+	//I EXPECT it can not be decrypted
+	_, err = s.Events(ctx, 0, id)
+	is.Err(t, err, "message authentication failed")
+}
+
+func TestKeyRotation(t *testing.T) {
+	k, dir := keys(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I save plain event, then encrypted with key 1 and with key 2
+	mem := cqrs.NewMemoryStorage()
+	is.NotErr(t, mem.Save(ctx, cqrs.CQRSAggregate{ID: id, Version: 1},
+		[]cqrs.Event{event(1, "legacy")}))
+
+	s := transform.NewStore(mem, transform.Encrypt(k))
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: id, Version: 2},
+		[]cqrs.Event{event(2, "first")}))
+	is.NotErr(t, k.Rotate("2"))
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: id, Version: 3},
+		[]cqrs.Event{event(3, "second")}))
+
+	//I EXPECT all of them loaded, also with keys read from file again
+	k2, err := transform.NewFileKeys(filepath.Join(dir, "keys.json"))
+	is.NotErr(t, err)
+	for _, kp := range []transform.KeyProvider{k, k2} {
+		es, err := transform.NewStore(mem, transform.Encrypt(kp)).Events(ctx, 0, id)
+		is.NotErr(t, err)
+		is.Equal(t, "legacy", string(es[0].Data))
+		is.Equal(t, "first", string(es[1].Data))
+		is.Equal(t, "second", string(es[2].Data))
+	}
+
+	//AND I EXPECT error when store has no keys
+	_, err = transform.NewStore(mem).Events(ctx, 0, id)
+	is.Err(t, err, "no key provider given")
+}
+
+func TestFailedKeyRotation(t *testing.T) {
+	k, dir := keys(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I rotate key which can not be written to file
+	path := filepath.Join(dir, "keys.json")
+	is.NotErr(t, os.Mkdir(path+".tmp", 0700))
+	is.Err(t, k.Rotate("2"), "key file not written")
+
+	//I EXPECT key 1 still current and key 2 unknown
+	id, _, err := k.Current()
+	is.NotErr(t, err)
+	is.Equal(t, "1", id)
+	_, err = k.Key("2")
+	is.Err(t, err, "not found")
+
+	//AND I EXPECT key 2 rotated once file is writable
+	is.NotErr(t, os.Remove(path+".tmp"))
+	is.NotErr(t, k.Rotate("2"))
+	id, _, err = k.Current()
+	is.NotErr(t, err)
+	is.Equal(t, "2", id)
+}
+
+func TestSnapshots(t *testing.T) {
+	k, dir := keys(t)
+	defer os.RemoveAll(dir)
+
+	mem := cqrs.NewMemoryStorage()
+	s := transform.NewStore(mem, transform.Compress(transform.Gzip), transform.Encrypt(k))
+	is.NotErr(t, s.Make(ctx, cqrs.Snapshot{AggregateID: id, Version: 3, Data: []byte("state")}))
+
+	_, raw := mem.Snapshot(ctx, id)
+	is.True(t, !bytes.Contains(raw, []byte("state")), "plain text stored")
+
+	v, data := s.Snapshot(ctx, id)
+	is.Equal(t, uint64(3), v)
+	is.Equal(t, "state", string(data))
+}
+
+func TestReadAll(t *testing.T) {
+	k, dir := keys(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I save encrypted event
+	mem := cqrs.NewMemoryStorage()
+	s := transform.NewStore(mem, transform.Encrypt(k))
+	es := []cqrs.Event{event(1, "secret")}
+	is.NotErr(t, s.Save(ctx, cqrs.CQRSAggregate{ID: id, Version: 1}, es))
+
+	//I EXPECT its position known and data decrypted in global log
+	is.Equal(t, uint64(1), es[0].Position)
+	rs, err := s.ReadAll(ctx, 0, 0, cqrs.Filter{})
+	is.NotErr(t, err)
+	is.Equal(t, "secret", string(rs[0].Data))
+}
+
+func TestDeadLetters(t *testing.T) {
+	k, dir := keys(t)
+	defer os.RemoveAll(dir)
+
+	//WHEN I put dead letter through compressing and encrypting dead letters
+	d, err := filestore.NewDeadLetters(filepath.Join(dir, "dead"))
+	is.NotErr(t, err)
+	s := transform.NewDeadLetters(d, transform.Compress(transform.Gzip), transform.Encrypt(k))
+	data := `{"Person":"Tom","Meal":"Pierogi"}`
+	es := []cqrs.Event{event(1, data)}
+	is.NotErr(t, s.Put(ctx, cqrs.DeadLetter{ID: "a", Handler: "mailer", Events: es}))
+
+	//I EXPECT no person in file of dead letter, nor in events I put
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "dead", "a.json"))
+	is.NotErr(t, err)
+	is.True(t, !bytes.Contains(raw, []byte("Tom")), "plain text stored")
+	is.Equal(t, data, string(es[0].Data))
+
+	//AND I EXPECT original data when dead letter is read
+	l, err := s.Get(ctx, "a")
+	is.NotErr(t, err)
+	is.Equal(t, data, string(l.Events[0].Data))
+
+	ls, err := s.List(ctx, "mailer")
+	is.NotErr(t, err)
+	is.Equal(t, data, string(ls[0].Events[0].Data))
+
+	//AND I EXPECT it can not be read without keys
+	_, err = transform.NewDeadLetters(d).Get(ctx, "a")
+	is.Err(t, err, "no key provider given")
+}
@@ -0,0 +1,238 @@
+// Package transform compresses and encrypts event and snapshot data before
+// it reaches cqrs.Store, and reverts that when data is read back.
+//
+// Transformed data is wrapped in an envelope which records compression and
+// encryption key id of every single event, so algorithms and keys might be
+// changed at any time without breaking already stored events. Data without
+// envelope (stored before transforms were enabled) is returned as it is.
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// magic starts every envelope, no codec output starts with zero byte.
+var magic = []byte{0x00, 'c', 'q', 'x', 0x01}
+
+// Compressor compresses data, Name is recorded in envelope.
+type Compressor interface {
+	Name() string
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+// KeyProvider provides AES keys (16, 24 or 32 bytes long) by their id.
+type KeyProvider interface {
+	// Current returns key which encrypts new data.
+	Current() (id string, key []byte, err error)
+	// Key returns key with given id, it is used for decryption.
+	Key(id string) ([]byte, error)
+}
+
+// Gzip is Compressor using compress/gzip.
+var Gzip Compressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// header of envelope.
+type header struct {
+	Compression string `json:"c,omitempty"`
+	Key         string `json:"k,omitempty"`
+}
+
+// pipeline compresses and then encrypts data.
+type pipeline struct {
+	compressor  Compressor
+	compressors map[string]Compressor
+	keys        KeyProvider
+}
+
+type Option func(*pipeline)
+
+func newPipeline(os ...Option) *pipeline {
+	p := &pipeline{compressors: map[string]Compressor{Gzip.Name(): Gzip}}
+	for _, o := range os {
+		o(p)
+	}
+
+	return p
+}
+
+// Compress new data with c. Data compressed by any of read Compressors
+// (and by c) can be decompressed.
+func Compress(c Compressor, read ...Compressor) Option {
+	return func(p *pipeline) {
+		for _, r := range append(read, c) {
+			p.compressors[r.Name()] = r
+		}
+		p.compressor = c
+	}
+}
+
+// Encrypt data with AES-GCM, using keys from k.
+func Encrypt(k KeyProvider) Option {
+	return func(p *pipeline) {
+		p.keys = k
+	}
+}
+
+// seal wraps data in envelope, aad (ie. event id) is authenticated with
+// data, so encrypted data can not be moved to another event.
+func (p *pipeline) seal(data, aad []byte) ([]byte, error) {
+	var h header
+	var err error
+
+	if p.compressor == nil && p.keys == nil {
+		return data, nil
+	}
+
+	if p.compressor != nil {
+		h.Compression = p.compressor.Name()
+		if data, err = p.compressor.Compress(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keys != nil {
+		var key []byte
+		if h.Key, key, err = p.keys.Current(); err != nil {
+			return nil, err
+		}
+		if data, err = encrypt(key, data, aad); err != nil {
+			return nil, err
+		}
+	}
+
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	b := append([]byte{}, magic...)
+	b = binary.AppendUvarint(b, uint64(len(hb)))
+	b = append(b, hb...)
+
+	return append(b, data...), nil
+}
+
+// open reverts seal, data without envelope is returned untouched.
+func (p *pipeline) open(data, aad []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return data, nil
+	}
+
+	data = data[len(magic):]
+	n, l := binary.Uvarint(data)
+	if l <= 0 || uint64(len(data)-l) < n {
+		return nil, fmt.Errorf("transform: malformed envelope")
+	}
+
+	var h header
+	if err := json.Unmarshal(data[l:l+int(n)], &h); err != nil {
+		return nil, fmt.Errorf("transform: malformed envelope header: %s", err)
+	}
+	data = data[l+int(n):]
+
+	var err error
+	if h.Key != "" {
+		if p.keys == nil {
+			return nil, fmt.Errorf("transform: data encrypted with %s key, "+
+				"but no key provider given", h.Key)
+		}
+
+		key, err := p.keys.Key(h.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		if data, err = decrypt(key, data, aad); err != nil {
+			return nil, fmt.Errorf("transform: %s key: %s", h.Key, err)
+		}
+	}
+
+	if h.Compression != "" {
+		c, ok := p.compressors[h.Compression]
+		if !ok {
+			return nil, fmt.Errorf("transform: %s compression is not registered",
+				h.Compression)
+		}
+
+		if data, err = c.Decompress(data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+func encrypt(key, data, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, aad), nil
+}
+
+func decrypt(key, data, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+
+	n := gcm.NonceSize()
+	return gcm.Open(nil, data[:n], data[n:], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(b)
+}
@@ -0,0 +1,137 @@
+package cqrsexample
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sokool/cqrsexample/codec"
+	"github.com/sokool/cqrsexample/cqrs"
+	"github.com/sokool/cqrsexample/events"
+	"github.com/sokool/gokit/test/is"
+)
+
+// stream is recorded restaurant events, stored in older schema versions,
+// with expected state after replay.
+type stream struct {
+	ID     string
+	Name   string
+	Meals  map[string]string
+	Events []struct {
+		Type    string
+		Schema  uint
+		Version uint64
+		Data    json.RawMessage
+	}
+}
+
+func TestReplayRecordedStreams(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "streams", "*.json"))
+	is.NotErr(t, err)
+	is.True(t, len(files) > 0, "expects recorded streams in testdata")
+
+	for _, f := range files {
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			var s stream
+			b, err := ioutil.ReadFile(f)
+			is.NotErr(t, err)
+			is.NotErr(t, json.Unmarshal(b, &s))
+
+			//WHEN I put recorded events into storage
+			ctx := context.Background()
+			store := cqrs.NewMemoryStorage()
+			repo := newRepository(cqrs.Storage(store))
+
+			var es []cqrs.Event
+			for _, e := range s.Events {
+				es = append(es, cqrs.Event{
+					ID:      fmt.Sprintf("%s-%012d", s.ID[:23], e.Version),
+					Type:    e.Type,
+					Schema:  e.Schema,
+					Data:    e.Data,
+					Version: e.Version,
+				})
+			}
+			is.NotErr(t, store.Save(ctx, cqrs.CQRSAggregate{
+				ID:      s.ID,
+				Type:    "aggregate",
+				Version: uint64(len(es)),
+			}, es))
+
+			//THEN I load restaurant
+			a, err := restaurant(repo.LoadContext(ctx, s.ID))
+
+			//I EXPECT state from recorded stream
+			is.NotErr(t, err)
+			is.Equal(t, uint64(len(es)), a.Root().Version)
+			is.Equal(t, s.Name, a.name)
+			for person, meal := range s.Meals {
+				is.Equal(t, meal, a.Meal(person))
+			}
+
+			//AND I EXPECT every event decoded in its current schema
+			for _, e := range es {
+				v, err := repo.Decode(e)
+				is.NotErr(t, err)
+				if c, ok := v.(*events.MealChanged); ok {
+					is.True(t, c.NewMeal != "", "%s: expects NewMeal", e.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestUpcastInStoredCodec(t *testing.T) {
+	// MealChanged as it was written in schema 1
+	type mealChanged struct {
+		Person       string    `protobuf:"1"`
+		PreviousMeal string    `protobuf:"2"`
+		ActualMeal   string    `protobuf:"3"`
+		At           time.Time `protobuf:"4"`
+	}
+
+	for _, c := range []cqrs.Codec{codec.MessagePack, codec.Protobuf} {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(&mealChanged{
+				Person:       "Tom",
+				PreviousMeal: "Pierogi",
+				ActualMeal:   "Schabowy",
+				At:           time.Unix(150, 0),
+			})
+			is.NotErr(t, err)
+
+			//WHEN I decode MealChanged stored in schema 1 with c
+			v, err := newRepository(cqrs.Codecs(cqrs.JSON, c)).Decode(cqrs.Event{
+				Type:   events.MealChangedName,
+				Schema: 1,
+				Codec:  c.Name(),
+				Data:   data,
+			})
+
+			//I EXPECT ActualMeal upcasted to NewMeal
+			is.NotErr(t, err)
+			m, ok := v.(*events.MealChanged)
+			is.True(t, ok, "expects MealChanged, got %T", v)
+			is.Equal(t, "Tom", m.Person)
+			is.Equal(t, "Pierogi", m.PreviousMeal)
+			is.Equal(t, "Schabowy", m.NewMeal)
+			is.Equal(t, int64(150), m.At.Unix())
+		})
+	}
+}
+
+func TestUpcastFromUnknownSchema(t *testing.T) {
+	//WHEN I decode MealChanged stored in schema newer than known
+	_, err := newRepository().Decode(cqrs.Event{
+		Type:   events.MealChangedName,
+		Schema: 3,
+		Data:   []byte(`{}`),
+	})
+
+	//I EXPECT newer schema error
+	is.Err(t, err, "newer than known")
+}